@@ -0,0 +1,152 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CacheControl holds the directives of Cache-Control header fields, by lowercase name, with
+// their unquoted values. Directives without a value map to the empty string.
+type CacheControl map[string]string
+
+// maxDeltaSeconds is the value used for delta-seconds too large to be represented, see
+// https://tools.ietf.org/html/rfc9111#section-1.2.2
+const maxDeltaSeconds = 2147483648
+
+// ParseCacheControl parses the Cache-Control header fields in headers, following the
+// grammar of https://tools.ietf.org/html/rfc9111#section-5.2
+//
+// Directive names are case-insensitive, and values may be tokens or quoted strings. When a
+// directive appears more than once, the most restrictive value is kept: the smallest of the
+// max-age, s-maxage, max-stale, stale-while-revalidate and stale-if-error values, the
+// largest min-fresh, and for no-cache and private, either no value if one occurrence has
+// none, or all the field names listed. Invalid delta-seconds values are read as 0, except
+// that max-stale and stale-if-error without a value accept any staleness. Other duplicated
+// directives keep their first value.
+func ParseCacheControl(headers http.Header) CacheControl {
+	cc := CacheControl{}
+	for _, value := range headers[http.CanonicalHeaderKey("Cache-Control")] {
+		for value != "" {
+			var name, arg string
+			name, arg, value = nextDirective(value)
+			if name != "" {
+				cc.add(name, arg)
+			}
+		}
+	}
+	return cc
+}
+
+// nextDirective parses the first directive in s, returning its lowercase name and value,
+// and the rest of s after the comma that ends it. The name is empty if the directive is
+// invalid.
+func nextDirective(s string) (name, value, rest string) {
+	s = strings.TrimLeft(s, " \t,")
+	i := 0
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	name, s = strings.ToLower(s[:i]), strings.TrimLeft(s[i:], " \t")
+	if strings.HasPrefix(s, "=") {
+		s = strings.TrimLeft(s[1:], " \t")
+		i = 0
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			for i = 1; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				// Skip the closing quote
+				i++
+			}
+			value = b.String()
+		} else {
+			for i < len(s) && isTokenChar(s[i]) {
+				i++
+			}
+			value = s[:i]
+		}
+		s = s[i:]
+	}
+	if s = strings.TrimLeft(s, " \t"); s != "" && s[0] != ',' {
+		// Trailing garbage makes the directive invalid
+		name = ""
+	}
+	if comma := strings.IndexByte(s, ','); comma >= 0 {
+		return name, value, s[comma+1:]
+	}
+	return name, value, ""
+}
+
+// add records the directive name with value, resolving conflicts with an earlier
+// occurrence.
+func (cc CacheControl) add(name, value string) {
+	old, dup := cc[name]
+	switch name {
+	case "max-age", "s-maxage", "max-stale", "min-fresh", "stale-while-revalidate", "stale-if-error":
+		if (name == "max-stale" || name == "stale-if-error") && value == "" {
+			// Any staleness is acceptable, the least restrictive value
+			if !dup {
+				cc[name] = ""
+			}
+			return
+		}
+		seconds := deltaSeconds(value)
+		if dup && old != "" {
+			oldSeconds := deltaSeconds(old)
+			if name == "min-fresh" && oldSeconds > seconds || name != "min-fresh" && oldSeconds < seconds {
+				seconds = oldSeconds
+			}
+		}
+		cc[name] = strconv.FormatInt(seconds, 10)
+	case "no-cache", "private":
+		if dup && (old == "" || value == "") {
+			cc[name] = ""
+		} else if dup {
+			cc[name] = old + ", " + value
+		} else {
+			cc[name] = value
+		}
+	default:
+		if !dup {
+			cc[name] = value
+		}
+	}
+}
+
+// Fields returns the field names listed in the value of directive, as in
+// no-cache="Set-Cookie", in canonical form. It returns nil if directive is absent or has no
+// value.
+func (cc CacheControl) Fields(directive string) []string {
+	var fields []string
+	for _, field := range strings.Split(cc[directive], ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, http.CanonicalHeaderKey(field))
+		}
+	}
+	return fields
+}
+
+// deltaSeconds parses a delta-seconds value, see
+// https://tools.ietf.org/html/rfc9111#section-1.2.2
+func deltaSeconds(s string) int64 {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0
+	}
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds > maxDeltaSeconds {
+		return maxDeltaSeconds
+	}
+	return seconds
+}
+
+// isTokenChar returns true if c may appear in a token, see
+// https://tools.ietf.org/html/rfc9110#section-5.6.2
+func isTokenChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c < 0x7f && strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
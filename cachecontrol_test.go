@@ -0,0 +1,87 @@
+package httpcache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseCacheControlGrammar(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   CacheControl
+	}{
+		{
+			[]string{`no-cache="Set-Cookie, X-Foo", max-age=60`},
+			CacheControl{"no-cache": "Set-Cookie, X-Foo", "max-age": "60"},
+		},
+		{
+			[]string{`Max-Age=60, PUBLIC`},
+			CacheControl{"max-age": "60", "public": ""},
+		},
+		{
+			[]string{`max-age="60" , private="a\"b"`},
+			CacheControl{"max-age": "60", "private": `a"b`},
+		},
+		{
+			[]string{"max-age=60", "no-store"},
+			CacheControl{"max-age": "60", "no-store": ""},
+		},
+		{
+			[]string{`,, foo=bar baz, =x, "y", no-transform`},
+			CacheControl{"no-transform": ""},
+		},
+		{
+			[]string{`ext="a,b", max-age=10`},
+			CacheControl{"ext": "a,b", "max-age": "10"},
+		},
+	}
+	for _, test := range tests {
+		got := ParseCacheControl(http.Header{"Cache-Control": test.header})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestParseCacheControlConflicts(t *testing.T) {
+	tests := []struct {
+		header string
+		want   CacheControl
+	}{
+		{"max-age=60, max-age=30", CacheControl{"max-age": "30"}},
+		{"max-age=30, max-age=60", CacheControl{"max-age": "30"}},
+		{"max-age=60, max-age=soon", CacheControl{"max-age": "0"}},
+		{"max-age=-1", CacheControl{"max-age": "0"}},
+		{"max-age=99999999999999999999", CacheControl{"max-age": "2147483648"}},
+		{"s-maxage=10, s-maxage=5", CacheControl{"s-maxage": "5"}},
+		{"min-fresh=10, min-fresh=20", CacheControl{"min-fresh": "20"}},
+		{"max-stale, max-stale=10", CacheControl{"max-stale": "10"}},
+		{"max-stale=10, max-stale", CacheControl{"max-stale": "10"}},
+		{"stale-if-error=10, stale-if-error=100", CacheControl{"stale-if-error": "10"}},
+		{"stale-if-error, stale-if-error=100", CacheControl{"stale-if-error": "100"}},
+		{`no-cache="Set-Cookie", no-cache="X-Foo"`, CacheControl{"no-cache": "Set-Cookie, X-Foo"}},
+		{`no-cache="Set-Cookie", no-cache`, CacheControl{"no-cache": ""}},
+		{`private, private="X-Foo"`, CacheControl{"private": ""}},
+		{"foo=1, foo=2", CacheControl{"foo": "1"}},
+	}
+	for _, test := range tests {
+		got := ParseCacheControl(http.Header{"Cache-Control": {test.header}})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestCacheControlFields(t *testing.T) {
+	cc := ParseCacheControl(http.Header{"Cache-Control": {`no-cache="set-cookie, ,x-foo", private`}})
+	if got, want := cc.Fields("no-cache"), []string{"Set-Cookie", "X-Foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got no-cache fields %q, want %q", got, want)
+	}
+	if got := cc.Fields("private"); got != nil {
+		t.Errorf("got private fields %q, want none", got)
+	}
+	if got := cc.Fields("max-age"); got != nil {
+		t.Errorf("got max-age fields %q, want none", got)
+	}
+}
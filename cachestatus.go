@@ -0,0 +1,97 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons for forwarding a request, as reported in the fwd parameter of Cache-Status. See
+// https://tools.ietf.org/html/rfc9211#section-2.2
+const (
+	fwdBypass   = "bypass"
+	fwdMethod   = "method"
+	fwdURIMiss  = "uri-miss"
+	fwdVaryMiss = "vary-miss"
+	fwdMiss     = "miss"
+	fwdRequest  = "request"
+	fwdStale    = "stale"
+)
+
+// cacheStatus records how the cache handled a request, to be reported in a Cache-Status
+// header.
+type cacheStatus struct {
+	hit       bool
+	fwd       string
+	fwdStatus int
+	stored    bool
+	collapsed bool
+}
+
+// addTo adds a member describing s, for the cache called name, to the Cache-Status header
+// of resp. See https://tools.ietf.org/html/rfc9211
+func (s *cacheStatus) addTo(resp *http.Response, name string, t *Transport) {
+	member := []string{cacheStatusName(name)}
+	if s.hit {
+		member = append(member, "hit")
+	} else if s.fwd != "" {
+		member = append(member, "fwd="+s.fwd)
+		if s.fwdStatus != 0 {
+			member = append(member, "fwd-status="+strconv.Itoa(s.fwdStatus))
+		}
+	}
+	if s.hit || s.stored {
+		if ttl, ok := t.ttl(resp); ok {
+			member = append(member, "ttl="+strconv.FormatInt(int64(ttl/time.Second), 10))
+		}
+	}
+	if s.stored {
+		member = append(member, "stored")
+	}
+	if s.collapsed {
+		member = append(member, "collapsed")
+	}
+	resp.Header.Add("Cache-Status", strings.Join(member, "; "))
+}
+
+// cacheStatusName returns name serialized as a token if possible, and as a string
+// otherwise. See https://tools.ietf.org/html/rfc8941#section-3.3
+func cacheStatusName(name string) string {
+	isToken := name != ""
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '*':
+		case i == 0:
+			isToken = false
+		case c >= '0' && c <= '9', c == ':', c == '/', c < 0x7f && strings.ContainsRune("!#$%&'+-.^_`|~", c):
+		default:
+			isToken = false
+		}
+	}
+	if isToken {
+		return name
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(name) + `"`
+}
+
+// ttl returns the remaining freshness lifetime of resp, which is about to be returned. It
+// is negative when resp is stale.
+func (t *Transport) ttl(resp *http.Response) (time.Duration, bool) {
+	date, err := Date(resp.Header)
+	if err != nil {
+		return 0, false
+	}
+	age := clock.since(date)
+	if seconds, err := strconv.ParseInt(resp.Header.Get("age"), 10, 64); err == nil {
+		if d := time.Duration(seconds) * time.Second; d > age {
+			age = d
+		}
+	}
+	if age < 0 {
+		age = 0
+	}
+	lifetime := t.lifetime(t.rule(resp.Request, resp), resp, ParseCacheControl(resp.Header), date)
+	return lifetime - age, true
+}
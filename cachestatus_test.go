@@ -0,0 +1,108 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheStatus(t *testing.T) {
+	resetTest()
+	clock = &fakeClock{}
+	upstream := &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Etag", `"abc"`)
+		header.Set("Vary", "Accept")
+		header.Set("Cache-Status", "origin; fwd=miss")
+		switch req.URL.Path {
+		case "/fresh":
+			header.Set("Cache-Control", "max-age=3600")
+		case "/stale":
+			header.Set("Cache-Control", "max-age=0")
+		}
+		if req.Header.Get("if-none-match") == `"abc"` {
+			return &http.Response{
+				StatusCode: http.StatusNotModified,
+				Header:     header,
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.CacheStatus = "test"
+
+	tests := []struct {
+		method       string
+		path         string
+		accept       string
+		cacheControl string
+		want         string
+	}{
+		{"POST", "/fresh", "", "", "test; fwd=method; fwd-status=200"},
+		{"GET", "/fresh", "", "", "test; fwd=uri-miss; fwd-status=200; ttl=3600; stored"},
+		{"GET", "/fresh", "", "", "test; hit; ttl=3600"},
+		{"GET", "/fresh", "text/html", "", "test; fwd=vary-miss; fwd-status=304; ttl=3600; stored"},
+		{"GET", "/fresh", "", "no-cache", "test; fwd=request; fwd-status=200; ttl=3600; stored"},
+		{"GET", "/stale", "", "", "test; fwd=uri-miss; fwd-status=200; ttl=0; stored"},
+		{"GET", "/stale", "", "", "test; fwd=stale; fwd-status=304; ttl=0; stored"},
+		{"GET", "/missing", "", "only-if-cached", "test"},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://example.com"+test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		if test.cacheControl != "" {
+			req.Header.Set("Cache-Control", test.cacheControl)
+		}
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		got := resp.Header["Cache-Status"]
+		if got[len(got)-1] != test.want {
+			t.Errorf("%d. %s %s: got Cache-Status %q, want %q", i, test.method, test.path, got[len(got)-1], test.want)
+		}
+		if test.path != "/missing" && (len(got) != 2 || got[0] != "origin; fwd=miss") {
+			t.Errorf("%d. %s %s: upstream Cache-Status wasn't kept: %q", i, test.method, test.path, got)
+		}
+	}
+
+	// The Cache-Status of this cache is never stored
+	req, _ := http.NewRequest("GET", "http://example.com/fresh", nil)
+	resp, err := CachedResponse(tp.Cache, req)
+	if err != nil || resp == nil {
+		t.Fatalf("got %v, %v; want cached response", resp, err)
+	}
+	if got := strings.Join(resp.Header["Cache-Status"], ", "); got != "origin; fwd=miss" {
+		t.Fatalf("got stored Cache-Status %q", got)
+	}
+}
+
+func TestCacheStatusName(t *testing.T) {
+	tests := map[string]string{
+		"ExampleCache": "ExampleCache",
+		"cdn:edge/1":   "cdn:edge/1",
+		"my cache":     `"my cache"`,
+		"1cache":       `"1cache"`,
+		`say "hi"`:     `"say \"hi\""`,
+	}
+	for name, want := range tests {
+		if got := cacheStatusName(name); got != want {
+			t.Errorf("%q: got %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package httpcache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCollapsedWait is the longest a collapsed request waits for the request it is
+// collapsed into, unless Transport.CollapsedWait is set.
+const DefaultCollapsedWait = 5 * time.Second
+
+// flight is an upstream request sent on behalf of all the concurrent requests for the
+// same cache key, when Transport.CollapsedForwarding is set.
+type flight struct {
+	done   chan struct{} // closed when the flight lands
+	once   sync.Once
+	stored bool // whether the response was stored, set before done is closed
+}
+
+// joinFlight returns the flight in progress for key. If there is none, a new flight is
+// started and leader is true: the caller must land it once its response is stored or
+// known not to be.
+func (t *Transport) joinFlight(key string) (f *flight, leader bool) {
+	t.flightsMu.Lock()
+	defer t.flightsMu.Unlock()
+	if f, ok := t.flights[key]; ok {
+		return f, false
+	}
+	if t.flights == nil {
+		t.flights = map[string]*flight{}
+	}
+	f = &flight{done: make(chan struct{})}
+	t.flights[key] = f
+	return f, true
+}
+
+// land ends the flight f for key, recording whether its response was stored. Only the
+// first call has any effect.
+func (t *Transport) land(key string, f *flight, stored bool) {
+	f.once.Do(func() {
+		t.flightsMu.Lock()
+		delete(t.flights, key)
+		t.flightsMu.Unlock()
+		f.stored = stored
+		close(f.done)
+	})
+}
+
+// awaitFlight waits for the flight f, led by another request, to land. It returns the
+// response stored by the flight if it is fresh for req, or nil if req has to be sent
+// upstream after all, as when the response must be revalidated or the flight doesn't
+// land within the CollapsedWait of t. An error is only returned if req is cancelled
+// while waiting.
+func (t *Transport) awaitFlight(f *flight, req *http.Request) (*http.Response, error) {
+	wait := t.CollapsedWait
+	if wait <= 0 {
+		wait = DefaultCollapsedWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-f.done:
+	case <-timer.C:
+		return nil, nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if !f.stored {
+		return nil, nil
+	}
+	resp, m, err := t.cachedResponse(req)
+	if err != nil || resp == nil {
+		return nil, nil
+	}
+	if !varyMatches(resp, m, req) || t.getFreshness(resp, m, req) != fresh {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if t.MarkCachedResponses {
+		resp.Header.Set(XFromCache, "1")
+	}
+	setAge(resp.Header, m)
+	return resp, nil
+}
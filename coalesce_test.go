@@ -0,0 +1,204 @@
+package httpcache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type collapsedResult struct {
+	body      string
+	fromCache bool
+	err       error
+}
+
+// collapsedGets sends n concurrent GET requests through tp, releasing upstream once they
+// all had time to reach the Transport. The requests are first passed to prepare, if any.
+func collapsedGets(tp *Transport, upstream *fakeTransport, n int, prepare ...func(req *http.Request) *http.Request) []collapsedResult {
+	results := make([]collapsedResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", fakeURL, nil)
+			for _, p := range prepare {
+				req = p(req)
+			}
+			resp, err := tp.RoundTrip(req)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			results[i] = collapsedResult{string(body), resp.Header.Get(XFromCache) == "1", err}
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+	return results
+}
+
+func TestCollapsedForwarding(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{release: make(chan struct{})}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.CollapsedForwarding = true
+
+	results := collapsedGets(tp, upstream, 20)
+	if got, want := upstream.count(), 1; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+	fromCache := 0
+	for _, result := range results {
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if result.body != "some data" {
+			t.Fatalf("got body %q, want %q", result.body, "some data")
+		}
+		if result.fromCache {
+			fromCache++
+		}
+	}
+	if got, want := fromCache, len(results)-1; got != want {
+		t.Fatalf("got %d responses from cache, want %d", got, want)
+	}
+}
+
+func TestCollapsedForwardingRevalidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		noCache bool // the response has Cache-Control: no-cache
+		prepare func(req *http.Request) *http.Request
+	}{
+		{"no-cache response", true, nil},
+		{"no-cache request", false, func(req *http.Request) *http.Request {
+			req.Header.Set("Cache-Control", "no-cache")
+			return req
+		}},
+		{"Revalidate", false, func(req *http.Request) *http.Request {
+			return req.WithContext(WithRequestOptions(req.Context(), RequestOptions{Revalidate: true}))
+		}},
+	}
+	for _, test := range tests {
+		resetTest()
+		upstream := &fakeTransport{release: make(chan struct{})}
+		if test.noCache {
+			upstream.header = http.Header{"Cache-Control": {"no-cache"}}
+		}
+		tp := NewMemoryCacheTransport()
+		tp.Transport = upstream
+		tp.CollapsedForwarding = true
+
+		var results []collapsedResult
+		if test.prepare != nil {
+			results = collapsedGets(tp, upstream, 5, test.prepare)
+		} else {
+			results = collapsedGets(tp, upstream, 5)
+		}
+		for _, result := range results {
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			if result.fromCache {
+				t.Fatalf("%s: response served from cache without revalidation", test.name)
+			}
+		}
+		if got, want := upstream.count(), len(results); got != want {
+			t.Fatalf("%s: got %d upstream requests, want %d", test.name, got, want)
+		}
+	}
+}
+
+func TestCollapsedForwardingLeaderFailure(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{release: make(chan struct{}), failures: 1}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.CollapsedForwarding = true
+
+	results := collapsedGets(tp, upstream, 5)
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			continue
+		}
+		if result.body != "some data" {
+			t.Fatalf("got body %q, want %q", result.body, "some data")
+		}
+	}
+	// Only the leader sees its error, the others are sent upstream again.
+	if failed != 1 {
+		t.Fatalf("got %d failed requests, want 1", failed)
+	}
+	if upstream.count() < 2 {
+		t.Fatalf("got %d upstream requests, want at least 2", upstream.count())
+	}
+}
+
+func TestCollapsedForwardingLeaderClosesEarly(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.CollapsedForwarding = true
+
+	req, _ := http.NewRequest("GET", fakeURL, nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// The leader's body is closed without being read, so nothing is stored.
+	resp.Body.Close()
+	<-done
+	if got, want := upstream.count(), 2; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+}
+
+func TestCollapsedForwardingLeaderStalls(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.CollapsedForwarding = true
+	tp.CollapsedWait = 50 * time.Millisecond
+
+	req, _ := http.NewRequest("GET", fakeURL, nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The leader's body isn't read, so the follower goes upstream once its wait is over.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp2, err := tp.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if got, want := upstream.count(), 2; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+}
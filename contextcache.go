@@ -0,0 +1,161 @@
+package httpcache
+
+import (
+	"context"
+	"strconv"
+)
+
+// A ContextCache is a cache whose operations take the context of the request they are made
+// for, so that they can be cancelled or time out along with it, and return their errors.
+// The Transport detects a Cache that is also a ContextCache, and then uses these methods in
+// its place, reporting the errors to OnCacheError. AsContextCache and AsCache adapt one
+// kind of cache to the other.
+type ContextCache interface {
+	// GetContext returns the []byte representation of a cached response and a bool set to
+	// true if the value isn't empty. A missing value is not an error.
+	GetContext(ctx context.Context, key string) (responseBytes []byte, ok bool, err error)
+	// SetContext stores the []byte representation of a response against a key.
+	SetContext(ctx context.Context, key string, responseBytes []byte) error
+	// DeleteContext removes the value associated with the key. A missing value is not an
+	// error.
+	DeleteContext(ctx context.Context, key string) error
+}
+
+// CacheError is an error returned by a cache, as reported to Transport.OnCacheError.
+type CacheError struct {
+	Op  string // the operation that failed: "get", "set", "delete", "open" or "create"
+	Key string
+	Err error
+}
+
+func (e *CacheError) Error() string {
+	return "httpcache: cache " + e.Op + " " + strconv.Quote(e.Key) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the cache.
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// AsContextCache returns c as a ContextCache. If c doesn't implement it, its operations
+// only fail if the context is done before they start.
+func AsContextCache(c Cache) ContextCache {
+	if cc, ok := c.(ContextCache); ok {
+		return cc
+	}
+	return contextCache{c}
+}
+
+// contextCache adapts a Cache to ContextCache.
+type contextCache struct {
+	Cache
+}
+
+func (c contextCache) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	b, ok := c.Get(key)
+	return b, ok, nil
+}
+
+func (c contextCache) SetContext(ctx context.Context, key string, responseBytes []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Set(key, responseBytes)
+	return nil
+}
+
+func (c contextCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Delete(key)
+	return nil
+}
+
+// AsCache returns c as a Cache, for use by a Transport. If c doesn't implement Cache, the
+// returned Cache is also a ContextCache that passes its calls to c; its Get, Set and Delete
+// methods use a background context, and errors make Get report a missing value and are
+// otherwise ignored.
+func AsCache(c ContextCache) Cache {
+	if adapter, ok := c.(contextCache); ok {
+		return adapter.Cache
+	}
+	if cache, ok := c.(Cache); ok {
+		return cache
+	}
+	return cacheAdapter{c}
+}
+
+// cacheAdapter adapts a ContextCache to Cache.
+type cacheAdapter struct {
+	ContextCache
+}
+
+func (c cacheAdapter) Get(key string) ([]byte, bool) {
+	b, ok, err := c.GetContext(context.Background(), key)
+	return b, ok && err == nil
+}
+
+func (c cacheAdapter) Set(key string, responseBytes []byte) {
+	c.SetContext(context.Background(), key, responseBytes)
+}
+
+func (c cacheAdapter) Delete(key string) {
+	c.DeleteContext(context.Background(), key)
+}
+
+// cacheGet gets the value under key from c, with ctx if c is a ContextCache.
+func cacheGet(ctx context.Context, c Cache, key string) ([]byte, bool, error) {
+	cc, ok := c.(ContextCache)
+	if !ok {
+		b, ok := c.Get(key)
+		return b, ok, nil
+	}
+	b, ok, err := cc.GetContext(ctx, key)
+	if err != nil {
+		return nil, false, &CacheError{Op: "get", Key: key, Err: err}
+	}
+	return b, ok, nil
+}
+
+// cacheGet returns the value under key in the Cache of t, reporting errors as missing
+// values.
+func (t *Transport) cacheGet(ctx context.Context, key string) ([]byte, bool) {
+	b, ok, err := cacheGet(ctx, t.Cache, key)
+	t.cacheError(err)
+	return b, ok
+}
+
+// cacheSet stores value under key in the Cache of t.
+func (t *Transport) cacheSet(ctx context.Context, key string, value []byte) {
+	cc, ok := t.Cache.(ContextCache)
+	if !ok {
+		t.Cache.Set(key, value)
+		return
+	}
+	if err := cc.SetContext(ctx, key, value); err != nil {
+		t.cacheError(&CacheError{Op: "set", Key: key, Err: err})
+	}
+}
+
+// cacheDelete removes the value under key from the Cache of t.
+func (t *Transport) cacheDelete(ctx context.Context, key string) {
+	cc, ok := t.Cache.(ContextCache)
+	if !ok {
+		t.Cache.Delete(key)
+		return
+	}
+	if err := cc.DeleteContext(ctx, key); err != nil {
+		t.cacheError(&CacheError{Op: "delete", Key: key, Err: err})
+	}
+}
+
+// cacheError reports err to OnCacheError, if neither is nil.
+func (t *Transport) cacheError(err error) {
+	if err != nil && t.OnCacheError != nil {
+		t.OnCacheError(err)
+	}
+}
@@ -0,0 +1,139 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+type ctxKey struct{}
+
+// failingCache is a ContextCache recording the contexts it is given, whose operations
+// fail while err is set.
+type failingCache struct {
+	Cache
+	err  error
+	ctxs []context.Context
+}
+
+func (c *failingCache) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	c.ctxs = append(c.ctxs, ctx)
+	if c.err != nil {
+		return nil, false, c.err
+	}
+	b, ok := c.Get(key)
+	return b, ok, nil
+}
+
+func (c *failingCache) SetContext(ctx context.Context, key string, b []byte) error {
+	c.ctxs = append(c.ctxs, ctx)
+	if c.err != nil {
+		return c.err
+	}
+	c.Set(key, b)
+	return nil
+}
+
+func (c *failingCache) DeleteContext(ctx context.Context, key string) error {
+	c.ctxs = append(c.ctxs, ctx)
+	if c.err != nil {
+		return c.err
+	}
+	c.Delete(key)
+	return nil
+}
+
+func TestContextCache(t *testing.T) {
+	resetTest()
+	cache := &failingCache{Cache: NewMemoryCache()}
+	tp := NewTransport(cache)
+	var cacheErrs []error
+	tp.OnCacheError = func(err error) {
+		cacheErrs = append(cacheErrs, err)
+	}
+	tp.Transport = &fakeTransport{}
+	get := func() *http.Response {
+		ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp, err := tp.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	get()
+	if resp := get(); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("response wasn't served from the cache")
+	}
+	if len(cache.ctxs) == 0 {
+		t.Fatal("ContextCache methods weren't used")
+	}
+	for _, ctx := range cache.ctxs {
+		if ctx.Value(ctxKey{}) != "request" {
+			t.Fatal("cache wasn't given the context of the request")
+		}
+	}
+
+	cache.err = errors.New("disk failure")
+	if resp := get(); resp.Header.Get(XFromCache) != "" {
+		t.Fatal("failed lookup wasn't handled as a miss")
+	}
+	if len(cacheErrs) == 0 {
+		t.Fatal("cache errors weren't reported")
+	}
+	for _, err := range cacheErrs {
+		cacheErr, ok := err.(*CacheError)
+		if !ok || cacheErr.Err != cache.err {
+			t.Errorf("got error %#v", err)
+		}
+	}
+}
+
+func TestCacheAdapters(t *testing.T) {
+	mem := NewMemoryCache()
+	if AsCache(AsContextCache(mem)) != Cache(mem) {
+		t.Error("adapting a Cache back and forth doesn't return it")
+	}
+
+	cc := &contextOnlyCache{failingCache{Cache: NewMemoryCache()}}
+	c := AsCache(cc)
+	if _, ok := c.(ContextCache); !ok {
+		t.Fatal("adapted ContextCache isn't a ContextCache")
+	}
+	c.Set("key", []byte("value"))
+	if b, ok := c.Get("key"); !ok || string(b) != "value" {
+		t.Fatalf("got %q, %v", b, ok)
+	}
+	cc.f.err = errors.New("failure")
+	if _, ok := c.Get("key"); ok {
+		t.Fatal("failed Get reported a value")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := AsContextCache(mem).GetContext(ctx, "key"); err != context.Canceled {
+		t.Fatalf("got error %v with a cancelled context", err)
+	}
+}
+
+// contextOnlyCache only implements ContextCache.
+type contextOnlyCache struct {
+	f failingCache
+}
+
+func (c *contextOnlyCache) GetContext(ctx context.Context, key string) ([]byte, bool, error) {
+	return c.f.GetContext(ctx, key)
+}
+
+func (c *contextOnlyCache) SetContext(ctx context.Context, key string, b []byte) error {
+	return c.f.SetContext(ctx, key, b)
+}
+
+func (c *contextOnlyCache) DeleteContext(ctx context.Context, key string) error {
+	return c.f.DeleteContext(ctx, key)
+}
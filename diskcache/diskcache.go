@@ -5,37 +5,158 @@ package diskcache
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"github.com/gregjones/httpcache"
 	"github.com/peterbourgon/diskv"
 	"io"
+	"io/ioutil"
+	"os"
 )
 
-// Cache is an implementation of httpcache.Cache that supplements the in-memory map with persistent storage
+// Cache is an implementation of httpcache.Cache, httpcache.ContextCache and
+// httpcache.ContextStreamingCache that supplements the in-memory map with persistent storage
 type Cache struct {
 	d *diskv.Diskv
 }
 
+var _ httpcache.ContextStreamingCache = (*Cache)(nil)
+
 // Get returns the response corresponding to key if present
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	key = keyToFilename(key)
-	resp, err := c.d.Read(key)
-	if err != nil {
-		return []byte{}, false
+	resp, ok, _ = c.GetContext(context.Background(), key)
+	return resp, ok
+}
+
+// GetContext returns the response corresponding to key if present. Failing to read it is
+// an error, unlike it being missing.
+func (c *Cache) GetContext(ctx context.Context, key string) (resp []byte, ok bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	resp, err = c.d.Read(keyToFilename(key))
+	if os.IsNotExist(err) {
+		return []byte{}, false, nil
+	} else if err != nil {
+		return []byte{}, false, err
 	}
-	return resp, true
+	return resp, true, nil
 }
 
 // Set saves a response to the cache as key
 func (c *Cache) Set(key string, resp []byte) {
-	key = keyToFilename(key)
-	c.d.WriteStream(key, bytes.NewReader(resp), true)
+	c.SetContext(context.Background(), key, resp)
+}
+
+// SetContext saves a response to the cache as key
+func (c *Cache) SetContext(ctx context.Context, key string, resp []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.d.WriteStream(keyToFilename(key), bytes.NewReader(resp), true)
+}
+
+// Open returns a reader for the response corresponding to key if present. It reads the
+// file directly, without going through the in-memory map.
+func (c *Cache) Open(key string) (io.ReadCloser, bool) {
+	r, ok, _ := c.OpenContext(context.Background(), key)
+	return r, ok
+}
+
+// OpenContext returns a reader for the response corresponding to key if present, like
+// Open. Failing to open it is an error, unlike it being missing.
+func (c *Cache) OpenContext(ctx context.Context, key string) (io.ReadCloser, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	r, err := c.d.ReadStream(keyToFilename(key), true)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+// Create returns a writer saving a response to the cache as key once closed. The response
+// is written to a temporary file, in the TempDir of the Diskv if set and in its BasePath
+// otherwise, which is then moved in place.
+func (c *Cache) Create(key string) (io.WriteCloser, error) {
+	dir := c.d.TempDir
+	if dir == "" {
+		dir = c.d.BasePath
+	}
+	if err := os.MkdirAll(dir, c.d.PathPerm); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "httpcache-")
+	if err != nil {
+		return nil, err
+	}
+	w := &writer{d: c.d, key: keyToFilename(key), f: f}
+	if c.d.Compression != nil {
+		if w.zw, err = c.d.Compression.Writer(f); err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// writer writes a response to a temporary file, which is moved in place once closed.
+type writer struct {
+	d   *diskv.Diskv
+	key string
+	f   *os.File
+	zw  io.WriteCloser // compresses to f, if the Diskv uses compression
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+	return w.f.Write(p)
+}
+
+// Close saves the response written to the cache.
+func (w *writer) Close() error {
+	var err error
+	if w.zw != nil {
+		err = w.zw.Close()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = w.d.Import(w.f.Name(), w.key, true)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+	}
+	return err
+}
+
+// Abort discards the response written, leaving the cache untouched.
+func (w *writer) Abort() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
 }
 
 // Delete removes the response with key from the cache
 func (c *Cache) Delete(key string) {
-	key = keyToFilename(key)
-	c.d.Erase(key)
+	c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes the response with key from the cache
+func (c *Cache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.d.Erase(keyToFilename(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func keyToFilename(key string) string {
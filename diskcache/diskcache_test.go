@@ -1,11 +1,14 @@
 package diskcache
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gregjones/httpcache/test"
+	"github.com/peterbourgon/diskv"
 )
 
 func TestDiskCache(t *testing.T) {
@@ -15,5 +18,30 @@ func TestDiskCache(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	test.Cache(t, New(tempDir))
+	cache := New(tempDir)
+	test.StreamingCache(t, cache)
+	test.ContextCache(t, cache)
+}
+
+func TestDiskCacheOpenError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache := NewWithDiskv(diskv.New(diskv.Options{
+		BasePath:    tempDir,
+		Compression: diskv.NewGzipCompression(),
+	}))
+	if _, ok, err := cache.OpenContext(context.Background(), "missing"); ok || err != nil {
+		t.Fatalf("got %v, %v opening a missing key, want a miss", ok, err)
+	}
+	// A file that can't be decompressed can't be read
+	if err := ioutil.WriteFile(filepath.Join(tempDir, keyToFilename("broken")), []byte("not gzip"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := cache.OpenContext(context.Background(), "broken"); ok || err == nil {
+		t.Fatalf("got %v, %v opening a broken value, want an error", ok, err)
+	}
 }
@@ -0,0 +1,175 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryPrefix starts the values storing responses in the entry format, followed by the
+// version of the format on the same line. The metadata of the entry follows, as header
+// fields ending with an empty line, and then the response as written by
+// httputil.DumpResponse.
+//
+// Values without the prefix are legacy entries, stored by earlier versions: a bare
+// response, whose request and response times are unknown. Partial content is only stored
+// as entries.
+const entryPrefix = "httpcache entry "
+
+// entryVersion is the version of the entry format written. Entries with a later version
+// are not read.
+const entryVersion = 1
+
+// entryRequestHeaderPrefix starts the names of the metadata fields holding the request
+// header fields stored with a response.
+const entryRequestHeaderPrefix = "Request-Header-"
+
+// errEntryVersion indicates an entry written in an unknown version of the entry format.
+var errEntryVersion = errors.New("httpcache: unsupported cache entry version")
+
+// entryMeta is the metadata stored along with a response.
+type entryMeta struct {
+	// key is the cache key of the response, shared by all of its variants.
+	key string
+	// method is the method of the request the response was stored for.
+	method string
+	// requestTime and responseTime are when the request was sent and its response
+	// received.
+	requestTime, responseTime time.Time
+	// etag and lastModified are the validators of the response.
+	etag, lastModified string
+	// requestHeader holds the fields of the request listed by the Vary header of the
+	// response, which select it among its variants.
+	requestHeader http.Header
+}
+
+// newEntryMeta returns the metadata of the response with the headers respHeaders, stored
+// under key for req, which may be nil, sent at requestTime and received at responseTime.
+func newEntryMeta(key string, req *http.Request, respHeaders http.Header, requestTime, responseTime time.Time) entryMeta {
+	m := entryMeta{
+		key:          key,
+		method:       http.MethodGet,
+		requestTime:  requestTime,
+		responseTime: responseTime,
+		etag:         respHeaders.Get("etag"),
+		lastModified: respHeaders.Get("last-modified"),
+	}
+	if req == nil {
+		return m
+	}
+	if req.Method != "" {
+		m.method = req.Method
+	}
+	for _, field := range headerAllCommaSepValues(respHeaders, "vary") {
+		field = http.CanonicalHeaderKey(field)
+		if values, ok := req.Header[field]; ok && field != "" {
+			if m.requestHeader == nil {
+				m.requestHeader = http.Header{}
+			}
+			m.requestHeader[field] = values
+		}
+	}
+	return m
+}
+
+// encode returns the beginning of the entry holding m, up to the stored response.
+func (m entryMeta) encode() []byte {
+	h := http.Header{}
+	h.Set("Key", m.key)
+	h.Set("Method", m.method)
+	if !m.requestTime.IsZero() {
+		h.Set("Request-Time", m.requestTime.UTC().Format(time.RFC3339Nano))
+	}
+	if !m.responseTime.IsZero() {
+		h.Set("Response-Time", m.responseTime.UTC().Format(time.RFC3339Nano))
+	}
+	if m.etag != "" {
+		h.Set("Etag", m.etag)
+	}
+	if m.lastModified != "" {
+		h.Set("Last-Modified", m.lastModified)
+	}
+	for field, values := range m.requestHeader {
+		h[entryRequestHeaderPrefix+field] = values
+	}
+	var b bytes.Buffer
+	b.WriteString(entryPrefix + strconv.Itoa(entryVersion) + "\n")
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// readEntryMeta reads the metadata at the beginning of the entry read by br, leaving br at
+// the start of the stored response. It returns false if the entry is a legacy one, which
+// has none.
+func readEntryMeta(br *bufio.Reader) (m entryMeta, ok bool, err error) {
+	if prefix, _ := br.Peek(len(entryPrefix)); string(prefix) != entryPrefix {
+		return m, false, nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return m, false, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(line[len(entryPrefix):]))
+	if err != nil || version < 1 || version > entryVersion {
+		return m, false, errEntryVersion
+	}
+	h, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return m, false, err
+	}
+	m.key = h.Get("Key")
+	m.method = h.Get("Method")
+	m.requestTime, _ = time.Parse(time.RFC3339Nano, h.Get("Request-Time"))
+	m.responseTime, _ = time.Parse(time.RFC3339Nano, h.Get("Response-Time"))
+	m.etag = h.Get("Etag")
+	m.lastModified = h.Get("Last-Modified")
+	for name, values := range h {
+		if strings.HasPrefix(name, entryRequestHeaderPrefix) {
+			if m.requestHeader == nil {
+				m.requestHeader = http.Header{}
+			}
+			m.requestHeader[name[len(entryRequestHeaderPrefix):]] = values
+		}
+	}
+	return m, true, nil
+}
+
+// variedHeaderPrefix starts the names of the fields in which earlier versions stored, with
+// the response, the request header fields listed by its Vary header.
+const variedHeaderPrefix = "X-Varied-"
+
+// migrateVaried removes from respHeaders the request header fields stored there by earlier
+// versions, recording them in m unless it already holds them.
+func (m *entryMeta) migrateVaried(respHeaders http.Header) {
+	for name, values := range respHeaders {
+		if !strings.HasPrefix(name, variedHeaderPrefix) {
+			continue
+		}
+		delete(respHeaders, name)
+		field := name[len(variedHeaderPrefix):]
+		if _, ok := m.requestHeader[field]; ok || field == "" {
+			continue
+		}
+		if m.requestHeader == nil {
+			m.requestHeader = http.Header{}
+		}
+		m.requestHeader[field] = values
+	}
+}
+
+// dumpEntry returns the entry storing resp, with its body if body is true, and the
+// metadata m. As with httputil.DumpResponse, the body of resp is replaced once read.
+func dumpEntry(m entryMeta, resp *http.Response, body bool) ([]byte, error) {
+	b, err := httputil.DumpResponse(resp, body)
+	if err != nil {
+		return nil, err
+	}
+	return append(m.encode(), b...), nil
+}
@@ -0,0 +1,147 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryMeta(t *testing.T) {
+	requestTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	responseTime := requestTime.Add(1500 * time.Millisecond)
+	respHeaders := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Wed, 01 May 2024 09:00:00 GMT"},
+		"Vary":          {"Accept, Accept-Language"},
+	}
+	req, _ := http.NewRequest("HEAD", "http://example.com/", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "test")
+
+	m := newEntryMeta("HEAD http://example.com/", req, respHeaders, requestTime, responseTime)
+	want := entryMeta{
+		key:           "HEAD http://example.com/",
+		method:        "HEAD",
+		requestTime:   requestTime,
+		responseTime:  responseTime,
+		etag:          `"v1"`,
+		lastModified:  "Wed, 01 May 2024 09:00:00 GMT",
+		requestHeader: http.Header{"Accept": {"text/html"}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got metadata %+v, want %+v", m, want)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(append(m.encode(), "HTTP/1.1 200 OK\r\n\r\n"...)))
+	got, ok, err := readEntryMeta(br)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v reading the metadata", ok, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got metadata %+v, want %+v", got, want)
+	}
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "HTTP/1.1 200 OK\r\n\r\n" {
+		t.Fatalf("got %q after the metadata", rest)
+	}
+
+	// Legacy entries have no metadata
+	br = bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n"))
+	if _, ok, err := readEntryMeta(br); ok || err != nil {
+		t.Fatalf("got %v, %v reading a legacy entry", ok, err)
+	}
+	if _, ok, err := readEntryMeta(bufio.NewReader(strings.NewReader(entryPrefix + "2\n\r\n"))); ok || err != errEntryVersion {
+		t.Fatalf("got %v, %v reading a later version", ok, err)
+	}
+}
+
+func TestEntryFormat(t *testing.T) {
+	resetTest()
+	cache := NewMemoryCache()
+	tp := NewTransport(cache)
+	upstream := &fakeTransport{body: "fresh data"}
+	tp.Transport = upstream
+
+	// Responses are stored as entries, with the times in their metadata
+	fetch(t, tp, "http://example.com/new")
+	b, _ := cache.Get("http://example.com/new")
+	if !bytes.HasPrefix(b, []byte(entryPrefix+strconv.Itoa(entryVersion)+"\n")) {
+		t.Fatalf("response isn't stored as an entry: %q", b)
+	}
+	br := bufio.NewReader(bytes.NewReader(b))
+	m, _, err := readEntryMeta(br)
+	if err != nil || m.key != "http://example.com/new" || m.method != "GET" || m.responseTime.IsZero() {
+		t.Fatalf("got metadata %+v, %v", m, err)
+	}
+	stored, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := bookkeepingHeader(stored.Header); name != "" {
+		t.Fatalf("%s is stored in the response headers", name)
+	}
+
+	// Legacy entries, stored without metadata by earlier versions, are read
+	legacy := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(len("legacy data")),
+		Body:          ioutil.NopCloser(strings.NewReader("legacy data")),
+	}
+	date := time.Now().Add(-time.Minute)
+	legacy.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	legacy.Header.Set("Cache-Control", "max-age=3600")
+	b, err = httputil.DumpResponse(legacy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("http://example.com/legacy", b)
+	resp, body := fetch(t, tp, "http://example.com/legacy")
+	if body != "legacy data" || resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf("legacy entry wasn't served: got %q", body)
+	}
+	if age, _ := strconv.Atoi(resp.Header.Get("Age")); age < 60 || age > 61 {
+		t.Fatalf("got Age %q, want about 60", resp.Header.Get("Age"))
+	}
+	if name := bookkeepingHeader(resp.Header); name != "" {
+		t.Fatalf("%s leaked into a legacy cached response", name)
+	}
+
+	// Nor into the responses returned by CachedResponse
+	for _, u := range []string{"http://example.com/new", "http://example.com/legacy"} {
+		req, _ := http.NewRequest("GET", u, nil)
+		for _, cached := range []func(*http.Request) (*http.Response, error){
+			tp.CachedResponse,
+			func(req *http.Request) (*http.Response, error) { return CachedResponse(cache, req) },
+		} {
+			resp, err := cached(req)
+			if err != nil || resp == nil {
+				t.Fatalf("%s isn't cached: %v", u, err)
+			}
+			resp.Body.Close()
+			if name := bookkeepingHeader(resp.Header); name != "" {
+				t.Fatalf("%s leaked into the cached response for %s", name, u)
+			}
+		}
+	}
+
+	// Entries written by a later version are misses, and are replaced
+	cache.Set("http://example.com/later", []byte(entryPrefix+"99\nSomething: new\r\n\r\n"))
+	if resp, body := fetch(t, tp, "http://example.com/later"); body != "fresh data" || resp.Header.Get(XFromCache) != "" {
+		t.Fatal("entry with an unknown version was served")
+	}
+	if resp, _ := fetch(t, tp, "http://example.com/later"); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("entry with an unknown version wasn't replaced")
+	}
+	if upstream.count() != 2 {
+		t.Fatalf("got %d upstream requests, want 2", upstream.count())
+	}
+}
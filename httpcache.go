@@ -1,19 +1,21 @@
 // Package httpcache provides a http.RoundTripper implementation that works as a
 // mostly RFC-compliant cache for http responses.
 //
-// It is only suitable for use as a 'private' cache (i.e. for a web-browser or an API-client
-// and not for a shared proxy).
+// By default it acts as a 'private' cache (i.e. for a web-browser or an API-client).
+// Setting Transport.Shared makes it follow the rules for a 'shared' cache instead, as
+// needed when responses are served to many users (e.g. by a proxy or gateway).
 //
 package httpcache
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -38,6 +40,32 @@ type Cache interface {
 	Delete(key string)
 }
 
+// A StreamingCache is a Cache that can also read and write the []byte representations of
+// responses as streams. The Transport detects it, and then neither reads cached responses
+// nor stores responses in full in memory.
+type StreamingCache interface {
+	Cache
+	// Open returns a reader for the []byte representation of the response cached under key,
+	// and a bool set to true if there is one.
+	Open(key string) (io.ReadCloser, bool)
+	// Create returns a writer for the []byte representation of a response to store against
+	// key. It replaces the value cached under key once the writer is closed. If the writer
+	// has an Abort() error method, it is called in place of Close when the response can't be
+	// written in full, and nothing must then be stored; otherwise the writer is closed and
+	// key deleted.
+	Create(key string) (io.WriteCloser, error)
+}
+
+// A ContextStreamingCache is a StreamingCache that opens values with the context of the
+// request they are read for. The Transport detects it, and then calls OpenContext in place
+// of Open, reporting its errors to OnCacheError.
+type ContextStreamingCache interface {
+	StreamingCache
+	// OpenContext returns a reader for the []byte representation of the response cached
+	// under key, and a bool set to true if there is one. A missing value is not an error.
+	OpenContext(ctx context.Context, key string) (io.ReadCloser, bool, error)
+}
+
 // cacheKey returns the cache key for req.
 func cacheKey(req *http.Request) string {
 	if req.Method == http.MethodGet {
@@ -48,15 +76,14 @@ func cacheKey(req *http.Request) string {
 }
 
 // CachedResponse returns the cached http.Response for req if present, and nil
-// otherwise.
+// otherwise. When several variants of the response are cached, it returns the one selected
+// by the headers of req.
+//
+// The response is looked up with the default cache key; use Transport.CachedResponse for a
+// Transport with a KeyFunc.
 func CachedResponse(c Cache, req *http.Request) (resp *http.Response, err error) {
-	cachedVal, ok := c.Get(cacheKey(req))
-	if !ok {
-		return
-	}
-
-	b := bytes.NewBuffer(cachedVal)
-	return http.ReadResponse(bufio.NewReader(b), req)
+	resp, _, _, err = cachedEntry(c, cacheKey(req), req)
+	return
 }
 
 // MemoryCache is an implemtation of Cache that stores responses in an in-memory map.
@@ -103,6 +130,101 @@ type Transport struct {
 	Cache     Cache
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
+	// MaxHeuristicFreshness caps the freshness lifetime assigned to responses that carry a
+	// Last-Modified header but no explicit expiration time. If zero, the lifetime is not capped.
+	MaxHeuristicFreshness time.Duration
+	// If true, responses without an explicit expiration time are never considered fresh
+	DisableHeuristicFreshness bool
+	// If true, the Transport behaves as a shared cache: s-maxage and proxy-revalidate are
+	// honored, private responses are not stored (or only without the fields listed by a
+	// qualified private directive), and responses to requests carrying an Authorization
+	// header are only stored when the response explicitly allows it.
+	Shared bool
+	// If true, concurrent requests for the same cache key that can't be served from the
+	// cache are collapsed: a single request is sent upstream, and the others wait for it
+	// and are served the response it stored. If nothing was stored, for example because
+	// the response wasn't cacheable or the request failed, they are sent upstream.
+	CollapsedForwarding bool
+	// CollapsedWait is the longest a collapsed request waits for the response to be stored,
+	// which happens once the body of the first request is read, before it is sent upstream
+	// anyway. If zero, DefaultCollapsedWait is used.
+	CollapsedWait time.Duration
+	// CacheableStatusCodes, if not empty, limits the status codes of the responses that are
+	// stored. Responses are only ever stored if their status code is cacheable by default, or
+	// if they carry explicit freshness information.
+	CacheableStatusCodes []int
+	// MaxCacheableBodySize, if positive, is the size in bytes of the largest response bodies
+	// stored. Bodies are copied as they are read to be stored; once a body grows larger, the
+	// copy is dropped and the rest of it streams through. Responses with a larger
+	// Content-Length are not copied at all, nor are partial responses to Range requests for a
+	// larger representation.
+	MaxCacheableBodySize int64
+	// IsStreaming, if not nil, reports whether a response is a streaming one, in place of
+	// IsStreamingResponse. Streaming responses are passed through untouched: they are never
+	// stored, and their bodies are not buffered.
+	IsStreaming func(resp *http.Response) bool
+	// If true, a response whose body is closed before io.EOF was read is stored anyway if all of
+	// it was read according to its Content-Length, as when a JSON decoder stops at the end of
+	// the value. Otherwise responses are only stored once their body is read to io.EOF.
+	CacheOnClose bool
+	// DrainOnClose, if positive, is the most that is read by Close from a body closed before
+	// it was read to io.EOF, so that the response can be stored anyway. Bodies with more than
+	// DrainOnClose bytes left according to their Content-Length are closed right away.
+	DrainOnClose int64
+	// InvalidateKeys, if not nil, is called when a request with an unsafe method (such as POST,
+	// PUT or DELETE) succeeds. The entries stored under the cache keys it returns are invalidated,
+	// along with the ones for the request URL and its Location and Content-Location targets. The
+	// cache key of a GET request is its URL, unless KeyFunc is set.
+	InvalidateKeys func(req *http.Request, resp *http.Response) []string
+	// KeyFunc, if not nil, returns the cache key under which the response to a request is
+	// stored, in place of the default one: its URL, prefixed with the method for methods other
+	// than GET. Requests with different methods must have different keys. NormalizedKey builds
+	// KeyFuncs that ignore irrelevant differences between URLs.
+	KeyFunc func(req *http.Request) string
+	// Policy, if not nil, overrides the caching rules for selected responses: their freshness
+	// lifetime, and whether their no-store and no-cache directives are honored.
+	Policy Policy
+	// OnCacheError, if not nil, is called with the errors of the Cache, if it is a
+	// ContextCache, as *CacheError values. Failed lookups are handled as misses, and failed
+	// writes are otherwise ignored. The context of each request is passed to the Cache, so
+	// that a slow cache doesn't hold it past its deadline.
+	OnCacheError func(err error)
+	// CacheStatus, if not empty, is the name under which responses are given a Cache-Status
+	// header (RFC 9211), telling whether they were served from the cache, or why the request
+	// was forwarded and whether the response was stored.
+	CacheStatus string
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight // upstream requests in progress, by cache key
+
+	revalidationMu      sync.Mutex
+	revalidating        map[string]bool // keys being revalidated in the background
+	revalidations       sync.WaitGroup
+	revalidationCtx     context.Context
+	cancelRevalidations context.CancelFunc
+	shutdown            bool
+}
+
+// key returns the cache key for req.
+func (t *Transport) key(req *http.Request) string {
+	if t.KeyFunc != nil {
+		return t.KeyFunc(req)
+	}
+	return cacheKey(req)
+}
+
+// CachedResponse returns the response cached by t for req if present, and nil otherwise.
+// Unlike the CachedResponse function, it uses the KeyFunc of t.
+func (t *Transport) CachedResponse(req *http.Request) (resp *http.Response, err error) {
+	resp, _, _, err = cachedEntry(t.Cache, t.key(req), req)
+	return
+}
+
+// cachedResponse returns the response cached by t for req, like CachedResponse, along with
+// the metadata of its entry.
+func (t *Transport) cachedResponse(req *http.Request) (resp *http.Response, m entryMeta, err error) {
+	resp, m, _, err = cachedEntry(t.Cache, t.key(req), req)
+	return
 }
 
 // NewTransport returns a new Transport with the
@@ -116,12 +238,17 @@ func (t *Transport) Client() *http.Client {
 	return &http.Client{Transport: t}
 }
 
-// varyMatches will return false unless all of the cached values for the headers listed in Vary
-// match the new request
-func varyMatches(cachedResp *http.Response, req *http.Request) bool {
+// varyMatches will return false unless all of the headers listed in the Vary header of
+// cachedResp have the same values in the new request as in the one it was stored for, as
+// recorded in m. A Vary of "*" never matches.
+func varyMatches(cachedResp *http.Response, m entryMeta, req *http.Request) bool {
 	for _, header := range headerAllCommaSepValues(cachedResp.Header, "vary") {
+		if header == "*" {
+			return false
+		}
 		header = http.CanonicalHeaderKey(header)
-		if header != "" && req.Header.Get(header) != cachedResp.Header.Get("X-Varied-"+header) {
+		if header != "" && strings.Join(headerAllCommaSepValues(req.Header, header), ",") !=
+			strings.Join(headerAllCommaSepValues(m.requestHeader, header), ",") {
 			return false
 		}
 	}
@@ -136,15 +263,65 @@ func varyMatches(cachedResp *http.Response, req *http.Request) bool {
 // If there is a stale Response, then any validators it contains will be set on the new request
 // to give the server a chance to respond with NotModified. If this happens, then the cached Response
 // will be returned.
+//
+// Range requests are answered from a fresh Response in the cache when there is one, either
+// complete or assembled from earlier partial responses, and are otherwise forwarded to the
+// server. The partial responses are stored, so that interrupted downloads can be resumed.
+//
+// The RequestOptions attached to the context of the request with WithRequestOptions change
+// how it is handled.
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	cacheKey := cacheKey(req)
+	var status cacheStatus
+	if t.CacheStatus != "" {
+		defer func() {
+			if resp != nil {
+				status.addTo(resp, t.CacheStatus, t)
+			}
+		}()
+	}
+
+	cacheKey := t.key(req)
+	opts := requestOptions(req)
+	if rule := t.rule(req, nil); rule != nil && rule.Bypass {
+		opts.SkipLookup, opts.SkipStore = true, true
+	}
+	rangeRequest := req.Method == "GET" && req.Header.Get("range") != ""
+	if rangeRequest && !opts.SkipLookup && !opts.Revalidate {
+		if resp := t.cachedRangeResponse(req); resp != nil {
+			status.hit = true
+			return resp, nil
+		}
+	}
 	cacheable := (req.Method == "GET" || req.Method == "HEAD") && req.Header.Get("range") == ""
 	var cachedResp *http.Response
-	if cacheable {
-		cachedResp, err = CachedResponse(t.Cache, req)
-	} else {
-		// Need to invalidate an existing value
-		t.Cache.Delete(cacheKey)
+	var cachedMeta entryMeta
+	var variants variantIndex
+	defer func() {
+		// Release the cached response if it isn't returned
+		if cachedResp != nil && resp != cachedResp {
+			cachedResp.Body.Close()
+		}
+	}()
+	if cacheable && !opts.SkipLookup {
+		cachedResp, cachedMeta, variants, err = cachedEntry(t.Cache, cacheKey, req)
+		if _, ok := err.(*CacheError); ok {
+			t.cacheError(err)
+		}
+	}
+	// Why the request would be forwarded, until the cached response is examined below
+	switch {
+	case !cacheable && !rangeRequest:
+		status.fwd = fwdMethod
+	case opts.SkipLookup:
+		status.fwd = fwdBypass
+	case cachedResp != nil && err == nil:
+		status.fwd = fwdVaryMiss
+	case variants != nil:
+		status.fwd = fwdVaryMiss
+	case cacheable && err == nil:
+		status.fwd = fwdURIMiss
+	default:
+		status.fwd = fwdMiss
 	}
 
 	transport := t.Transport
@@ -157,14 +334,25 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 			cachedResp.Header.Set(XFromCache, "1")
 		}
 
-		if varyMatches(cachedResp, req) {
+		if varyMatches(cachedResp, cachedMeta, req) {
 			// Can only use cached value if the new request doesn't Vary significantly
-			freshness := getFreshness(cachedResp.Header, req.Header)
+			freshness := t.getFreshness(cachedResp, cachedMeta, req)
 			if freshness == fresh {
+				status.hit = true
+				setAge(cachedResp.Header, cachedMeta)
+				return cachedResp, nil
+			}
+
+			if freshness == stale && t.canStaleWhileRevalidate(cachedResp, cachedMeta, req) &&
+				t.revalidateInBackground(cacheKey, req) {
+				status.hit = true
+				setAge(cachedResp.Header, cachedMeta)
 				return cachedResp, nil
 			}
 
+			status.fwd = fwdRequest
 			if freshness == stale {
+				status.fwd = fwdStale
 				var req2 *http.Request
 				// Add validators if caller hasn't already done so
 				etag := cachedResp.Header.Get("etag")
@@ -185,70 +373,206 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 			}
 		}
 
+		if onlyIfCached(req) {
+			// The cached response would otherwise be revalidated, but the request must not
+			// be forwarded
+			if !varyMatches(cachedResp, cachedMeta, req) {
+				status.fwd = ""
+				return newGatewayTimeoutResponse(req), nil
+			}
+			status.hit = true
+			setAge(cachedResp.Header, cachedMeta)
+			return cachedResp, nil
+		}
+	}
+
+	// leader is the flight led by this request when collapsing forwarded requests. It
+	// lands once the response is known not to be stored, or has been stored. Requests
+	// that must be revalidated are never collapsed, as they can't be served the response
+	// stored by another.
+	var leader *flight
+	_, noCache := ParseCacheControl(req.Header)["no-cache"]
+	if cacheable && t.CollapsedForwarding && !onlyIfCached(req) && !opts.SkipLookup && !opts.SkipStore &&
+		!opts.Revalidate && !noCache {
+		f, isLeader := t.joinFlight(cacheKey)
+		if isLeader {
+			leader = f
+			defer func() {
+				if leader != nil {
+					t.land(cacheKey, leader, false)
+				}
+			}()
+		} else {
+			collapsedResp, err := t.awaitFlight(f, req)
+			if err != nil {
+				return nil, err
+			}
+			if collapsedResp != nil {
+				status.collapsed = true
+				return collapsedResp, nil
+			}
+		}
+	}
+
+	requestTime := clock.now()
+	var responseTime time.Time
+	if cacheable && cachedResp != nil && err == nil {
 		resp, err = transport.RoundTrip(req)
+		responseTime = clock.now()
+		if err == nil {
+			status.fwdStatus = resp.StatusCode
+		}
 		if err == nil && req.Method == "GET" && resp.StatusCode == http.StatusNotModified {
-			// Replace the 304 response with the one from cache, but update with some new headers
-			endToEndHeaders := getEndToEndHeaders(resp.Header)
-			for _, header := range endToEndHeaders {
-				cachedResp.Header[header] = resp.Header[header]
-			}
+			// Replace the 304 response with the one from cache, but update with some new headers.
+			updateNotModified(cachedResp, &cachedMeta, resp, requestTime, responseTime)
 			resp = cachedResp
 		} else if (err != nil || (cachedResp != nil && resp.StatusCode >= 500)) &&
-			req.Method == "GET" && canStaleOnError(cachedResp.Header, req.Header) {
+			req.Method == "GET" && t.canStaleOnError(cachedResp.Header, cachedMeta, req.Header, t.rule(req, cachedResp)) {
 			// In case of transport failure and stale-if-error activated, returns cached content
 			// when available
+			setAge(cachedResp.Header, cachedMeta)
 			return cachedResp, nil
-		} else {
-			if err != nil || resp.StatusCode != http.StatusOK {
-				t.Cache.Delete(cacheKey)
-			}
-			if err != nil {
-				return nil, err
-			}
+		} else if err != nil {
+			t.deleteResponse(cacheKey, req)
+			return nil, err
 		}
 	} else {
-		reqCacheControl := parseCacheControl(req.Header)
-		if _, ok := reqCacheControl["only-if-cached"]; ok {
+		if onlyIfCached(req) {
 			resp = newGatewayTimeoutResponse(req)
+			responseTime = requestTime
+			status.fwd = ""
 		} else {
-			resp, err = transport.RoundTrip(req)
+			// Other variants may be selected by the server, when it can tell which with
+			// their validators.
+			var selected *http.Response
+			if cacheable && len(variants.etags()) > 0 && req.Header.Get("if-none-match") == "" {
+				resp, selected, err = t.fetchVariant(transport, req, cacheKey, variants)
+			} else if cacheable && req.Method == "GET" && !opts.SkipLookup {
+				resp, err = t.fetchResuming(transport, req, cacheKey)
+			} else {
+				resp, err = transport.RoundTrip(req)
+			}
+			responseTime = clock.now()
 			if err != nil {
 				return nil, err
 			}
+			status.fwdStatus = resp.StatusCode
+			if selected != nil {
+				if t.MarkCachedResponses {
+					selected.Header.Set(XFromCache, "1")
+				}
+				cachedMeta = entryMeta{}
+				updateNotModified(selected, &cachedMeta, resp, requestTime, responseTime)
+				cachedResp, resp = selected, selected
+			}
 		}
 	}
 
-	if cacheable && canStore(parseCacheControl(req.Header), parseCacheControl(resp.Header)) {
-		for _, varyKey := range headerAllCommaSepValues(resp.Header, "vary") {
-			varyKey = http.CanonicalHeaderKey(varyKey)
-			fakeHeader := "X-Varied-" + varyKey
-			reqValue := req.Header.Get(varyKey)
-			if reqValue != "" {
-				resp.Header.Set(fakeHeader, reqValue)
-			}
-		}
+	store := !opts.SkipStore
+	if store && cacheable && resp.StatusCode != http.StatusPartialContent && !t.tooLarge(resp) && !t.isStreaming(resp) && t.canStore(req, resp) {
+		status.stored = true
+		stored := *resp
+		stored.Header = t.storedHeader(resp.Header)
+		setMissingDate(stored.Header, responseTime)
+		storedMeta := newEntryMeta(cacheKey, req, stored.Header, requestTime, responseTime)
 		switch req.Method {
 		case "GET":
-			// Delay caching until EOF is reached.
-			resp.Body = &cachingReadCloser{
-				R: resp.Body,
-				OnEOF: func(r io.Reader) {
-					resp := *resp
-					resp.Body = ioutil.NopCloser(r)
-					respBytes, err := httputil.DumpResponse(&resp, true)
+			// Delay caching until EOF is reached. If the body is closed before that, what
+			// was read is kept as partial content, unless the cache is a StreamingCache.
+			f := leader
+			leader = nil
+			landed := func(stored bool) {
+				if f != nil {
+					t.land(cacheKey, f, stored)
+				}
+			}
+			body := &cachingReadCloser{
+				R:               resp.Body,
+				Limit:           t.MaxCacheableBodySize,
+				Size:            resp.ContentLength,
+				CompleteOnClose: t.CacheOnClose,
+				DrainLimit:      t.DrainOnClose,
+				OnLimit:         func() { landed(false) },
+			}
+			if sc, ok := t.Cache.(StreamingCache); ok {
+				// The response is written to the cache as it is read, and is not kept as
+				// partial content
+				ctx := req.Context()
+				entryKey, commit := t.beginStore(ctx, cacheKey, req, stored.Header)
+				w, err := t.createEntry(ctx, sc, entryKey, storedMeta, &stored)
+				if err != nil {
+					status.stored = false
+					landed(false)
+					break
+				}
+				body.W = w
+				body.OnEOF = func(io.Reader) {
+					ok := t.closeEntry(entryKey, w)
+					if ok && stored.ContentLength < 0 {
+						ok = t.sizeEntry(ctx, sc, entryKey, body.n)
+					}
+					if ok {
+						commit()
+					}
+					landed(ok)
+				}
+				body.OnLimit = func() {
+					t.abortEntry(ctx, entryKey, w)
+					landed(false)
+				}
+				body.OnClose = func(io.Reader) {
+					t.abortEntry(ctx, entryKey, w)
+					landed(false)
+				}
+			} else {
+				resumable := resp != cachedResp && resp.StatusCode == http.StatusOK &&
+					resp.ContentLength > 0 && resp.Header.Get("vary") == ""
+				body.OnEOF = func(r io.Reader) {
+					if stored.ContentLength < 0 {
+						// The length is known once the body is read, and is stored so that
+						// the ranges of the response can be served without reading it in full
+						stored.ContentLength = body.n
+						stored.TransferEncoding = nil
+						stored.Header.Set("Content-Length", strconv.FormatInt(body.n, 10))
+					}
+					stored.Body = ioutil.NopCloser(r)
+					respBytes, err := dumpEntry(storedMeta, &stored, true)
 					if err == nil {
-						t.Cache.Set(cacheKey, respBytes)
+						t.storeResponse(req.Context(), cacheKey, req, stored.Header, respBytes)
+					}
+					landed(err == nil)
+				}
+				body.OnClose = func(r io.Reader) {
+					landed(false)
+					if resumable {
+						data, err := ioutil.ReadAll(r)
+						if err == nil {
+							t.storePartial(req.Context(), storedMeta, stored.Header, stored.ContentLength, 0, data)
+						}
 					}
-				},
+				}
 			}
+			resp.Body = body
 		default:
-			respBytes, err := httputil.DumpResponse(resp, true)
+			respBytes, err := dumpEntry(storedMeta, &stored, true)
+			resp.Body = stored.Body
 			if err == nil {
-				t.Cache.Set(cacheKey, respBytes)
+				t.storeResponse(req.Context(), cacheKey, req, stored.Header, respBytes)
+				if leader != nil {
+					t.land(cacheKey, leader, true)
+				}
 			}
 		}
-	} else {
-		t.Cache.Delete(cacheKey)
+	} else if store && rangeRequest {
+		t.storePartialResponse(cacheKey, req, resp, requestTime, responseTime)
+	} else if store && cacheable {
+		t.deleteResponse(cacheKey, req)
+	} else if !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+		// Need to invalidate existing values
+		t.invalidate(req, resp)
+	}
+	if resp == cachedResp {
+		setAge(resp.Header, cachedMeta)
 	}
 	return resp, nil
 }
@@ -264,7 +588,32 @@ func Date(respHeaders http.Header) (date time.Time, err error) {
 		return
 	}
 
-	return time.Parse(time.RFC1123, dateHeader)
+	return ParseHTTPDate(dateHeader)
+}
+
+// httpDateFormats are the formats accepted by ParseHTTPDate, the preferred one first.
+var httpDateFormats = []string{
+	http.TimeFormat,
+	time.RFC850,
+	time.ANSIC,
+	// Not allowed, but seen in practice
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Monday, 02-Jan-2006 15:04:05 MST",
+}
+
+// ParseHTTPDate parses an HTTP-date in any of the formats of
+// https://tools.ietf.org/html/rfc9110#section-5.6.7 (like http.ParseTime), as well as the
+// close variants sent by some servers, with a numeric zone or a four digit year. The
+// result is in UTC.
+func ParseHTTPDate(value string) (t time.Time, err error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range httpDateFormats {
+		if t, err = time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return t, err
 }
 
 type realClock struct{}
@@ -273,12 +622,74 @@ func (c *realClock) since(d time.Time) time.Duration {
 	return time.Since(d)
 }
 
+func (c *realClock) now() time.Time {
+	return time.Now()
+}
+
 type timer interface {
 	since(d time.Time) time.Duration
+	now() time.Time
 }
 
 var clock timer = &realClock{}
 
+// setMissingDate adds a Date header to a response received at responseTime if it had none,
+// or replaces an invalid one, see https://tools.ietf.org/html/rfc9110#section-6.6.1
+func setMissingDate(respHeaders http.Header, responseTime time.Time) {
+	if _, err := Date(respHeaders); err != nil {
+		respHeaders.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// getCurrentAge returns the current age of a stored response with the headers respHeaders
+// and the metadata m, calculated as described in
+// https://tools.ietf.org/html/rfc9111#section-4.2.3
+//
+// Responses stored without a record of their request and response times are taken to
+// have been received at their Date.
+func getCurrentAge(respHeaders http.Header, m entryMeta) (age time.Duration, err error) {
+	date, err := Date(respHeaders)
+	if err != nil {
+		return 0, err
+	}
+	requestTime, responseTime := date, date
+	if !m.responseTime.IsZero() {
+		requestTime, responseTime = m.responseTime, m.responseTime
+	}
+	if !m.requestTime.IsZero() {
+		requestTime = m.requestTime
+	}
+
+	apparentAge := responseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(respHeaders.Get("age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAgeValue := ageValue + responseTime.Sub(requestTime)
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	residentTime := clock.since(responseTime)
+	return correctedInitialAge + residentTime, nil
+}
+
+// setAge sets the Age header of a response with the metadata m about to be returned from
+// the cache to its current age.
+func setAge(respHeaders http.Header, m entryMeta) {
+	age, err := getCurrentAge(respHeaders, m)
+	if err != nil {
+		return
+	}
+	if age < 0 {
+		age = 0
+	}
+	respHeaders.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
+
 // getFreshness will return one of fresh/stale/transparent based on the cache-control
 // values of the request and the response
 //
@@ -286,18 +697,25 @@ var clock timer = &realClock{}
 // stale indicates that the response needs validating before it is returned
 // transparent indicates the response should not be used to fulfil the request
 //
-// Because this is only a private cache, 'public' and 'private' in cache-control aren't
-// signficant. Similarly, smax-age isn't used.
-func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
-	respCacheControl := parseCacheControl(respHeaders)
-	reqCacheControl := parseCacheControl(reqHeaders)
+// s-maxage is only used when the Transport is a shared cache. m is the metadata stored
+// with resp.
+func (t *Transport) getFreshness(resp *http.Response, m entryMeta, req *http.Request) (freshness int) {
+	respHeaders, reqHeaders := resp.Header, req.Header
+	respCacheControl := ParseCacheControl(respHeaders)
+	reqCacheControl := ParseCacheControl(reqHeaders)
 	if _, ok := reqCacheControl["no-cache"]; ok {
 		return transparent
 	}
-	if _, ok := respCacheControl["no-cache"]; ok {
+	rule := t.rule(req, resp)
+	// A no-cache directive listing fields only prevents those from being stored
+	if noCache, ok := respCacheControl["no-cache"]; ok && noCache == "" && (rule == nil || !rule.IgnoreNoCache) {
+		return stale
+	}
+	opts := requestOptions(req)
+	if opts.Revalidate {
 		return stale
 	}
-	if _, ok := reqCacheControl["only-if-cached"]; ok {
+	if onlyIfCached(req) {
 		return fresh
 	}
 
@@ -305,29 +723,16 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	if err != nil {
 		return stale
 	}
-	currentAge := clock.since(date)
-
-	var lifetime time.Duration
-	var zeroDuration time.Duration
+	currentAge, err := getCurrentAge(respHeaders, m)
+	if err != nil {
+		return stale
+	}
 
-	// If a response includes both an Expires header and a max-age directive,
-	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
-	if maxAge, ok := respCacheControl["max-age"]; ok {
-		lifetime, err = time.ParseDuration(maxAge + "s")
-		if err != nil {
-			lifetime = zeroDuration
-		}
-	} else {
-		expiresHeader := respHeaders.Get("Expires")
-		if expiresHeader != "" {
-			expires, err := time.Parse(time.RFC1123, expiresHeader)
-			if err != nil {
-				lifetime = zeroDuration
-			} else {
-				lifetime = expires.Sub(date)
-			}
-		}
+	lifetime := t.lifetime(rule, resp, respCacheControl, date)
+	if opts.FreshnessLifetime != 0 {
+		lifetime = opts.FreshnessLifetime
 	}
+	var zeroDuration time.Duration
 
 	if maxAge, ok := reqCacheControl["max-age"]; ok {
 		// the client is willing to accept a response whose age is no greater than the specified time in seconds
@@ -344,7 +749,8 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 		}
 	}
 
-	if maxstale, ok := reqCacheControl["max-stale"]; ok {
+	// Stale responses are never served when the response requires revalidation.
+	if maxstale, ok := reqCacheControl["max-stale"]; ok && !t.mustRevalidate(respCacheControl) {
 		// Indicates that the client is willing to accept a response that has exceeded its expiration time.
 		// If max-stale is assigned a value, then the client is willing to accept a response that has exceeded
 		// its expiration time by no more than the specified number of seconds.
@@ -369,11 +775,105 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	return stale
 }
 
+// freshnessLifetime returns the freshness lifetime of resp, as given by the response
+// itself or assigned heuristically when it has no explicit expiration time.
+func (t *Transport) freshnessLifetime(resp *http.Response, respCacheControl CacheControl, date time.Time) (lifetime time.Duration) {
+	var err error
+	// If a response includes both an Expires header and a max-age directive,
+	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
+	// In a shared cache, s-maxage overrides both.
+	if sMaxAge, ok := respCacheControl["s-maxage"]; ok && t.Shared {
+		lifetime, err = time.ParseDuration(sMaxAge + "s")
+		if err != nil {
+			return 0
+		}
+	} else if maxAge, ok := respCacheControl["max-age"]; ok {
+		lifetime, err = time.ParseDuration(maxAge + "s")
+		if err != nil {
+			return 0
+		}
+	} else if expiresHeader := resp.Header.Get("Expires"); expiresHeader != "" {
+		// An invalid date, such as "0", means that the response has already expired
+		expires, err := ParseHTTPDate(expiresHeader)
+		if err != nil {
+			return 0
+		}
+		lifetime = expires.Sub(date)
+	} else {
+		lifetime = t.heuristicLifetime(resp, respCacheControl, date)
+	}
+	return lifetime
+}
+
+// heuristicallyCacheable lists the status codes that are cacheable by default,
+// see https://tools.ietf.org/html/rfc9110#section-15.1
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusPartialContent:       true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// heuristicLifetime returns the freshness lifetime of a response that has no explicit
+// expiration time: 10% of the time elapsed between Last-Modified and Date, as suggested by
+// https://tools.ietf.org/html/rfc9111#section-4.2.2
+//
+// Only responses with a heuristically cacheable status code, or marked as public, are
+// given a heuristic lifetime.
+func (t *Transport) heuristicLifetime(resp *http.Response, respCacheControl CacheControl, date time.Time) time.Duration {
+	if t.DisableHeuristicFreshness {
+		return 0
+	}
+	if _, ok := respCacheControl["public"]; !ok && !heuristicallyCacheable[resp.StatusCode] {
+		return 0
+	}
+	lastModified, err := ParseHTTPDate(resp.Header.Get("last-modified"))
+	if err != nil || !lastModified.Before(date) {
+		return 0
+	}
+	lifetime := date.Sub(lastModified) / 10
+	if t.MaxHeuristicFreshness > 0 && lifetime > t.MaxHeuristicFreshness {
+		lifetime = t.MaxHeuristicFreshness
+	}
+	return lifetime
+}
+
+// mustRevalidate reports whether a stale response must be revalidated before it is used,
+// whatever the request or stale-if-error allow. In a shared cache, proxy-revalidate and
+// s-maxage have the same effect as must-revalidate.
+func (t *Transport) mustRevalidate(respCacheControl CacheControl) bool {
+	if _, ok := respCacheControl["must-revalidate"]; ok {
+		return true
+	}
+	if t.Shared {
+		if _, ok := respCacheControl["proxy-revalidate"]; ok {
+			return true
+		}
+		if _, ok := respCacheControl["s-maxage"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns true if either the request or the response includes the stale-if-error
 // cache control extension: https://tools.ietf.org/html/rfc5861
-func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
-	respCacheControl := parseCacheControl(respHeaders)
-	reqCacheControl := parseCacheControl(reqHeaders)
+// or if rule, when not nil, sets a StaleIfError window. m is the metadata stored with the
+// response.
+func (t *Transport) canStaleOnError(respHeaders http.Header, m entryMeta, reqHeaders http.Header, rule *Rule) bool {
+	respCacheControl := ParseCacheControl(respHeaders)
+	reqCacheControl := ParseCacheControl(reqHeaders)
+	if t.mustRevalidate(respCacheControl) {
+		return false
+	}
 
 	var err error
 	lifetime := time.Duration(-1)
@@ -398,13 +898,15 @@ func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
 			return true
 		}
 	}
+	if rule != nil && rule.StaleIfError != 0 {
+		lifetime = rule.StaleIfError
+	}
 
 	if lifetime >= 0 {
-		date, err := Date(respHeaders)
+		currentAge, err := getCurrentAge(respHeaders, m)
 		if err != nil {
 			return false
 		}
-		currentAge := clock.since(date)
 		if lifetime > currentAge {
 			return true
 		}
@@ -441,16 +943,106 @@ func getEndToEndHeaders(respHeaders http.Header) []string {
 	return endToEndHeaders
 }
 
-func canStore(reqCacheControl, respCacheControl cacheControl) (canStore bool) {
-	if _, ok := respCacheControl["no-store"]; ok {
+func (t *Transport) canStore(req *http.Request, resp *http.Response) (canStore bool) {
+	reqCacheControl := ParseCacheControl(req.Header)
+	respCacheControl := ParseCacheControl(resp.Header)
+	rule := t.rule(req, resp)
+	if !t.storableStatus(resp, respCacheControl, rule) {
+		return false
+	}
+	if _, ok := respCacheControl["no-store"]; ok && (rule == nil || !rule.IgnoreNoStore) {
 		return false
 	}
 	if _, ok := reqCacheControl["no-store"]; ok {
 		return false
 	}
+	for _, header := range headerAllCommaSepValues(resp.Header, "vary") {
+		if header == "*" {
+			// No later request could be served with it
+			return false
+		}
+	}
+	if t.Shared {
+		// A private directive listing fields only prevents those from being stored
+		if private, ok := respCacheControl["private"]; ok && private == "" {
+			return false
+		}
+		if req.Header.Get("authorization") != "" && !allowsAuthorizedStorage(respCacheControl) {
+			return false
+		}
+	}
 	return true
 }
 
+// storableStatus returns true if the status code of resp allows it to be stored: it must
+// be cacheable by default, unless the response carries explicit freshness information, see
+// https://tools.ietf.org/html/rfc9111#section-3
+func (t *Transport) storableStatus(resp *http.Response, respCacheControl CacheControl, rule *Rule) bool {
+	if resp.StatusCode < 200 || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if len(t.CacheableStatusCodes) > 0 {
+		allowed := false
+		for _, code := range t.CacheableStatusCodes {
+			if code == resp.StatusCode {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if rule != nil && len(rule.CacheableStatusCodes) > 0 {
+		allowed := false
+		for _, code := range rule.CacheableStatusCodes {
+			if code == resp.StatusCode {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if heuristicallyCacheable[resp.StatusCode] {
+		return true
+	}
+	if _, ok := respCacheControl["public"]; ok {
+		return true
+	}
+	if rule != nil && (rule.DefaultTTL != 0 || rule.MinTTL != 0) &&
+		(len(rule.StatusCodes) > 0 || len(rule.CacheableStatusCodes) > 0 || len(t.CacheableStatusCodes) > 0) {
+		// The status codes stored were listed explicitly
+		return true
+	}
+	return t.hasExplicitExpiration(resp, respCacheControl)
+}
+
+// hasExplicitExpiration returns true if resp carries an explicit expiration time, see
+// https://tools.ietf.org/html/rfc9111#section-4.2.1
+func (t *Transport) hasExplicitExpiration(resp *http.Response, respCacheControl CacheControl) bool {
+	if _, ok := respCacheControl["max-age"]; ok {
+		return true
+	}
+	if _, ok := respCacheControl["s-maxage"]; ok && t.Shared {
+		return true
+	}
+	return resp.Header.Get("expires") != ""
+}
+
+// allowsAuthorizedStorage reports whether a shared cache may store the response to a
+// request containing an Authorization header, see
+// https://tools.ietf.org/html/rfc9111#section-3.5
+func allowsAuthorizedStorage(respCacheControl CacheControl) bool {
+	for _, directive := range []string{"public", "must-revalidate", "s-maxage"} {
+		if _, ok := respCacheControl[directive]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func newGatewayTimeoutResponse(req *http.Request) *http.Response {
 	var braw bytes.Buffer
 	braw.WriteString("HTTP/1.1 504 Gateway Timeout\r\n\r\n")
@@ -476,24 +1068,31 @@ func cloneRequest(r *http.Request) *http.Request {
 	return r2
 }
 
-type cacheControl map[string]string
-
-func parseCacheControl(headers http.Header) cacheControl {
-	cc := cacheControl{}
-	ccHeader := headers.Get("Cache-Control")
-	for _, part := range strings.Split(ccHeader, ",") {
-		part = strings.Trim(part, " ")
-		if part == "" {
-			continue
-		}
-		if strings.ContainsRune(part, '=') {
-			keyval := strings.Split(part, "=")
-			cc[strings.Trim(keyval[0], " ")] = strings.Trim(keyval[1], ",")
-		} else {
-			cc[part] = ""
+// storedHeader returns a copy of respHeaders to be stored, without the fields that may not
+// be reused without revalidation, listed by a no-cache directive, nor, in a shared cache,
+// those listed by a private directive. See
+// https://tools.ietf.org/html/rfc9111#section-5.2.2.4
+func (t *Transport) storedHeader(respHeaders http.Header) http.Header {
+	h := cloneHeader(respHeaders)
+	respCacheControl := ParseCacheControl(respHeaders)
+	for _, field := range respCacheControl.Fields("no-cache") {
+		h.Del(field)
+	}
+	if t.Shared {
+		for _, field := range respCacheControl.Fields("private") {
+			h.Del(field)
 		}
 	}
-	return cc
+	return h
+}
+
+// cloneHeader returns a copy of h that can be modified without affecting h.
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		h2[k] = append([]string(nil), vv...)
+	}
+	return h2
 }
 
 // headerAllCommaSepValues returns all comma-separated values (each
@@ -522,8 +1121,33 @@ type cachingReadCloser struct {
 	R io.ReadCloser
 	// OnEOF is called with a copy of the content of R when EOF is reached.
 	OnEOF func(io.Reader)
+	// OnClose, if not nil, is called with a copy of the content read from R
+	// when it is closed before EOF is reached.
+	OnClose func(io.Reader)
+	// W, if not nil, is written the content of R as it is read, in place of
+	// the copy: OnEOF and OnClose are then called with a nil io.Reader.
+	W io.Writer
+	// Limit, if positive, is the size of the largest copy kept. Once more is
+	// read from R, or if writing to W fails, the copy is dropped, OnLimit is
+	// called if not nil, and neither OnEOF nor OnClose are called.
+	Limit   int64
+	OnLimit func()
+	// Size is the length of the content of R, or -1 if unknown.
+	Size int64
+	// If true, R is considered drained when closed once Size bytes were
+	// read, and OnEOF is called.
+	CompleteOnClose bool
+	// DrainLimit, if positive, is the most that is read from R by Close
+	// before EOF, in order to reach it. If Size tells that more remains, R
+	// is not drained. R is drained before Close returns, while the context
+	// of the request is still live.
+	DrainLimit int64
 
-	buf bytes.Buffer // buf stores a copy of the content of R.
+	buf     bytes.Buffer // buf stores a copy of the content of R.
+	n       int64        // n is the number of bytes read from R.
+	eof     bool         // eof is set once EOF has been reached.
+	dropped bool         // dropped is set once the copy was dropped.
+	closed  bool         // closed is set once Close has been called.
 }
 
 // Read reads the next len(p) bytes from R or until R is drained. The
@@ -532,17 +1156,89 @@ type cachingReadCloser struct {
 // has been read so far.
 func (r *cachingReadCloser) Read(p []byte) (n int, err error) {
 	n, err = r.R.Read(p)
-	r.buf.Write(p[:n])
-	if err == io.EOF {
-		r.OnEOF(bytes.NewReader(r.buf.Bytes()))
+	if r.dropped {
+		return n, err
+	}
+	r.n += int64(n)
+	if r.Limit > 0 && r.n > r.Limit {
+		r.drop()
+		return n, err
+	}
+	if r.W == nil {
+		r.buf.Write(p[:n])
+	} else if _, werr := r.W.Write(p[:n]); werr != nil {
+		r.drop()
+		return n, err
+	}
+	if err == io.EOF && !r.eof {
+		r.eof = true
+		r.OnEOF(r.copy())
 	}
 	return n, err
 }
 
+// drop drops the copy of the content of R.
+func (r *cachingReadCloser) drop() {
+	r.dropped = true
+	r.buf = bytes.Buffer{}
+	if r.OnLimit != nil {
+		r.OnLimit()
+	}
+}
+
+// copy returns the copy of the content read from R, or nil if it is written
+// to W.
+func (r *cachingReadCloser) copy() io.Reader {
+	if r.W != nil {
+		return nil
+	}
+	return bytes.NewReader(r.buf.Bytes())
+}
+
 func (r *cachingReadCloser) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.eof || r.dropped {
+		return r.R.Close()
+	}
+	if r.CompleteOnClose && r.Size >= 0 && r.n == r.Size {
+		r.eof = true
+		r.OnEOF(r.copy())
+		return r.R.Close()
+	}
+	if r.DrainLimit > 0 && (r.Size < 0 || r.Size-r.n <= r.DrainLimit) {
+		return r.drain()
+	}
+	r.closeEarly()
+	return r.R.Close()
+}
+
+// drain reads R up to EOF, or until more than DrainLimit bytes were read,
+// and closes it.
+func (r *cachingReadCloser) drain() error {
+	// One more byte than the limit is read so that EOF is reached after it
+	io.Copy(ioutil.Discard, io.LimitReader(r, r.DrainLimit+1))
+	if !r.eof && !r.dropped {
+		r.closeEarly()
+	}
 	return r.R.Close()
 }
 
+// closeEarly calls OnClose, if not nil, as R is closed before EOF.
+func (r *cachingReadCloser) closeEarly() {
+	if r.OnClose != nil {
+		r.OnClose(r.copy())
+	}
+}
+
+// tooLarge returns true if the body of resp is known to be larger than the
+// MaxCacheableBodySize of t.
+func (t *Transport) tooLarge(resp *http.Response) bool {
+	return t.MaxCacheableBodySize > 0 && resp.ContentLength > t.MaxCacheableBodySize
+}
+
 // NewMemoryCacheTransport returns a new Transport using the in-memory cache implementation
 func NewMemoryCacheTransport() *Transport {
 	c := NewMemoryCache()
@@ -2,6 +2,7 @@ package httpcache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -29,6 +32,10 @@ func (c *fakeClock) since(t time.Time) time.Duration {
 	return c.elapsed
 }
 
+func (c *fakeClock) now() time.Time {
+	return time.Now()
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	setup()
@@ -398,6 +405,93 @@ func TestCacheOnlyIfBodyRead(t *testing.T) {
 	}
 }
 
+func TestCacheOnClose(t *testing.T) {
+	resetTest()
+	tests := []struct {
+		cacheOnClose  bool
+		drainOnClose  int64
+		contentLength int64
+		read          int
+		want          bool
+	}{
+		{false, 0, 100, 100, false},
+		{true, 0, 100, 100, true},
+		{true, 0, 100, 99, false},
+		{true, 0, -1, 100, false},
+		{false, 100, 100, 0, true},
+		{false, 50, 100, 50, true},
+		{false, 50, 100, 49, false},
+		{false, 100, -1, 0, true},
+		{false, 99, -1, 0, false},
+	}
+	for i, test := range tests {
+		tp := NewMemoryCacheTransport()
+		tp.CacheOnClose = test.cacheOnClose
+		tp.DrainOnClose = test.drainOnClose
+		tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			header.Set("Cache-Control", "max-age=3600")
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        header,
+				ContentLength: test.contentLength,
+				Body:          ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100))),
+			}, nil
+		}}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(resp.Body, make([]byte, test.read)); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if _, ok := tp.Cache.Get(cacheKey(req)); ok != test.want {
+			t.Errorf("%d. %+v: got stored %v, want %v", i, test, ok, test.want)
+		}
+	}
+}
+
+// contextBody is a body whose reads fail once the context of its request is done, as
+// with http.Transport.
+type contextBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (b contextBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+func TestDrainOnCloseWithClientTimeout(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.DrainOnClose = 1 << 20
+	upstream := &fakeTransport{}
+	upstream.respond = func(req *http.Request) (*http.Response, error) {
+		resp := upstream.serve(req, `"abc"`, strings.Repeat("x", 100))
+		resp.Body = contextBody{resp.Body, req.Context()}
+		return resp, nil
+	}
+	tp.Transport = upstream
+	// The client cancels the context of the request once the body is closed
+	client := &http.Client{Transport: tp, Timeout: 10 * time.Second}
+	resp, err := client.Get(fakeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, body := fetch(t, tp, "")
+	if resp.Header.Get(XFromCache) != "1" || body != strings.Repeat("x", 100) {
+		t.Fatalf("got %q from cache %q, want the drained response stored", body, resp.Header.Get(XFromCache))
+	}
+}
+
 func TestOnlyReadBodyOnDemand(t *testing.T) {
 	resetTest()
 
@@ -916,13 +1010,13 @@ func TestCachedErrorsKeepStatus(t *testing.T) {
 func TestParseCacheControl(t *testing.T) {
 	resetTest()
 	h := http.Header{}
-	for range parseCacheControl(h) {
+	for range ParseCacheControl(h) {
 		t.Fatal("cacheControl should be empty")
 	}
 
 	h.Set("cache-control", "no-cache")
 	{
-		cc := parseCacheControl(h)
+		cc := ParseCacheControl(h)
 		if _, ok := cc["foo"]; ok {
 			t.Error(`Value "foo" shouldn't exist`)
 		}
@@ -936,7 +1030,7 @@ func TestParseCacheControl(t *testing.T) {
 	}
 	h.Set("cache-control", "no-cache, max-age=3600")
 	{
-		cc := parseCacheControl(h)
+		cc := ParseCacheControl(h)
 		noCache, ok := cc["no-cache"]
 		if !ok {
 			t.Fatalf(`"no-cache" value isn't set`)
@@ -950,6 +1044,14 @@ func TestParseCacheControl(t *testing.T) {
 	}
 }
 
+// getFreshness returns the freshness of a 200 response with respHeaders to a request
+// with reqHeaders, as computed by a Transport with the default settings.
+func getFreshness(respHeaders, reqHeaders http.Header) int {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: respHeaders}
+	req := &http.Request{Header: reqHeaders}
+	return (&Transport{}).getFreshness(resp, entryMeta{}, req)
+}
+
 func TestNoCacheRequestExpiration(t *testing.T) {
 	resetTest()
 	respHeaders := http.Header{}
@@ -1126,6 +1228,343 @@ func TestMaxStaleValue(t *testing.T) {
 	}
 }
 
+func TestAgeHeaderExpiration(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("cache-control", "max-age=60")
+	respHeaders.Set("age", "30")
+
+	reqHeaders := http.Header{}
+	clock = &fakeClock{elapsed: 20 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+
+	clock = &fakeClock{elapsed: 40 * time.Second}
+	if getFreshness(respHeaders, reqHeaders) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
+func TestCurrentAge(t *testing.T) {
+	resetTest()
+	date := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	respHeaders := http.Header{}
+	respHeaders.Set("date", date.Format(time.RFC1123))
+	clock = &fakeClock{elapsed: 10 * time.Second}
+
+	// Without recorded times, the response is taken to have been received at its Date.
+	age, err := getCurrentAge(respHeaders, entryMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age != 10*time.Second {
+		t.Fatalf("got age %v, want %v", age, 10*time.Second)
+	}
+
+	// The response took 5 seconds to arrive, and was received 20 seconds after its Date.
+	m := entryMeta{requestTime: date.Add(15 * time.Second), responseTime: date.Add(20 * time.Second)}
+	age, err = getCurrentAge(respHeaders, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age != 30*time.Second {
+		t.Fatalf("got age %v, want %v", age, 30*time.Second)
+	}
+
+	// A larger Age header, corrected by the response delay, wins over the apparent age.
+	respHeaders.Set("age", "100")
+	age, err = getCurrentAge(respHeaders, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age != 115*time.Second {
+		t.Fatalf("got age %v, want %v", age, 115*time.Second)
+	}
+}
+
+func TestAgeHeaderOnCachedResponse(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusOK),
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Date":          []string{now.Format(time.RFC1123)},
+				"Cache-Control": []string{"max-age=3600"},
+				"Age":           []string{"100"},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer([]byte("some data"))),
+		},
+	}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &tmock
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock = &fakeClock{elapsed: 50 * time.Second}
+	resp, err = tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	age, err := strconv.Atoi(resp.Header.Get("Age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age < 150 || age > 152 {
+		t.Fatalf("Age header isn't about 150: %d", age)
+	}
+	if name := bookkeepingHeader(resp.Header); name != "" {
+		t.Fatalf("%s leaked into cached response", name)
+	}
+}
+
+func TestSharedMaxAge(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("date", now.Format(time.RFC1123))
+	resp.Header.Set("cache-control", "max-age=60, s-maxage=10")
+	req := &http.Request{Header: http.Header{}}
+
+	clock = &fakeClock{elapsed: 30 * time.Second}
+	if (&Transport{}).getFreshness(resp, entryMeta{}, req) != fresh {
+		t.Fatal("freshness isn't fresh for a private cache")
+	}
+	if (&Transport{Shared: true}).getFreshness(resp, entryMeta{}, req) != stale {
+		t.Fatal("freshness isn't stale for a shared cache")
+	}
+}
+
+func TestMaxStaleMustRevalidate(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("date", now.Format(time.RFC1123))
+	resp.Header.Set("cache-control", "max-age=10, proxy-revalidate")
+	req := &http.Request{Header: http.Header{}}
+	req.Header.Set("cache-control", "max-stale")
+
+	clock = &fakeClock{elapsed: 30 * time.Second}
+	if (&Transport{}).getFreshness(resp, entryMeta{}, req) != fresh {
+		t.Fatal("freshness isn't fresh for a private cache")
+	}
+	if (&Transport{Shared: true}).getFreshness(resp, entryMeta{}, req) != stale {
+		t.Fatal("freshness isn't stale for a shared cache")
+	}
+
+	resp.Header.Set("cache-control", "max-age=10, must-revalidate")
+	if (&Transport{}).getFreshness(resp, entryMeta{}, req) != stale {
+		t.Fatal("freshness isn't stale for a private cache")
+	}
+}
+
+func TestSharedCanStore(t *testing.T) {
+	resetTest()
+	private := &Transport{}
+	shared := &Transport{Shared: true}
+	tests := []struct {
+		cacheControl  string
+		authorization bool
+		private       bool
+		shared        bool
+	}{
+		{"max-age=60", false, true, true},
+		{"private, max-age=60", false, true, false},
+		{`private="Set-Cookie", max-age=60`, false, true, true},
+		{"max-age=60", true, true, false},
+		{"public, max-age=60", true, true, true},
+		{"must-revalidate, max-age=60", true, true, true},
+		{"s-maxage=60", true, true, true},
+		{"no-store", false, false, false},
+	}
+	for _, test := range tests {
+		req := &http.Request{Header: http.Header{}}
+		if test.authorization {
+			req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {test.cacheControl}}}
+		if got := private.canStore(req, resp); got != test.private {
+			t.Errorf("private cache, %q (authorization %v): got %v, want %v", test.cacheControl, test.authorization, got, test.private)
+		}
+		if got := shared.canStore(req, resp); got != test.shared {
+			t.Errorf("shared cache, %q (authorization %v): got %v, want %v", test.cacheControl, test.authorization, got, test.shared)
+		}
+	}
+}
+
+func TestCanStoreStatus(t *testing.T) {
+	resetTest()
+	tests := []struct {
+		status int
+		header http.Header
+		shared bool
+		store  bool
+	}{
+		{http.StatusOK, http.Header{}, false, true},
+		{http.StatusMovedPermanently, http.Header{}, false, true},
+		{http.StatusNoContent, http.Header{}, false, true},
+		{http.StatusGone, http.Header{}, false, true},
+		{http.StatusFound, http.Header{}, false, false},
+		{http.StatusFound, http.Header{"Cache-Control": {"max-age=60"}}, false, true},
+		{http.StatusFound, http.Header{"Cache-Control": {"public"}}, false, true},
+		{http.StatusFound, http.Header{"Expires": {"Wed, 19 Apr 3000 11:43:00 GMT"}}, false, true},
+		{http.StatusFound, http.Header{"Cache-Control": {"s-maxage=60"}}, false, false},
+		{http.StatusFound, http.Header{"Cache-Control": {"s-maxage=60"}}, true, true},
+		{http.StatusInternalServerError, http.Header{}, false, false},
+		{http.StatusNotModified, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+	}
+	for _, test := range tests {
+		tp := &Transport{Shared: test.shared}
+		req := &http.Request{Header: http.Header{}}
+		resp := &http.Response{StatusCode: test.status, Header: test.header}
+		if got := tp.canStore(req, resp); got != test.store {
+			t.Errorf("status %d, %v (shared %v): got %v, want %v", test.status, test.header, test.shared, got, test.store)
+		}
+	}
+
+	tp := &Transport{CacheableStatusCodes: []int{http.StatusOK}}
+	req := &http.Request{Header: http.Header{}}
+	if tp.canStore(req, &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}}) {
+		t.Error("status 404 stored despite CacheableStatusCodes")
+	}
+	if !tp.canStore(req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}) {
+		t.Error("status 200 not stored despite CacheableStatusCodes")
+	}
+}
+
+func TestCacheRedirect(t *testing.T) {
+	resetTest()
+	tmock := transportMock{
+		response: &http.Response{
+			Status:     http.StatusText(http.StatusMovedPermanently),
+			StatusCode: http.StatusMovedPermanently,
+			Header: http.Header{
+				"Date":          []string{time.Now().Format(time.RFC1123)},
+				"Cache-Control": []string{"max-age=3600"},
+				"Location":      []string{"http://somewhere.com/else"},
+			},
+			Body: ioutil.NopCloser(bytes.NewBuffer(nil)),
+		},
+	}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &tmock
+
+	r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+	resp, err := tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmock.err = errors.New("unexpected upstream request")
+	resp, err = tp.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("Status wasn't 301: %d", resp.StatusCode)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("last-modified", now.Add(-100*time.Hour).Format(time.RFC1123))
+
+	reqHeaders := http.Header{}
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+
+	clock = &fakeClock{elapsed: 9 * time.Hour}
+	if getFreshness(respHeaders, reqHeaders) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+
+	clock = &fakeClock{elapsed: 11 * time.Hour}
+	if getFreshness(respHeaders, reqHeaders) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
+func TestHeuristicFreshnessExplicitExpiration(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	respHeaders := http.Header{}
+	respHeaders.Set("date", now.Format(time.RFC1123))
+	respHeaders.Set("last-modified", now.Add(-100*time.Hour).Format(time.RFC1123))
+	respHeaders.Set("cache-control", "max-age=60")
+
+	reqHeaders := http.Header{}
+	clock = &fakeClock{elapsed: time.Hour}
+	if getFreshness(respHeaders, reqHeaders) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
+func TestHeuristicFreshnessStatus(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{}}
+	resp.Header.Set("date", now.Format(time.RFC1123))
+	resp.Header.Set("last-modified", now.Add(-100*time.Hour).Format(time.RFC1123))
+	req := &http.Request{Header: http.Header{}}
+
+	tp := &Transport{}
+	if tp.getFreshness(resp, entryMeta{}, req) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+
+	resp.Header.Set("cache-control", "public")
+	if tp.getFreshness(resp, entryMeta{}, req) != fresh {
+		t.Fatal("freshness isn't fresh")
+	}
+}
+
+func TestHeuristicFreshnessSettings(t *testing.T) {
+	resetTest()
+	now := time.Now()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("date", now.Format(time.RFC1123))
+	resp.Header.Set("last-modified", now.Add(-100*time.Hour).Format(time.RFC1123))
+	req := &http.Request{Header: http.Header{}}
+
+	clock = &fakeClock{elapsed: 2 * time.Hour}
+	tp := &Transport{MaxHeuristicFreshness: time.Hour}
+	if tp.getFreshness(resp, entryMeta{}, req) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+
+	tp = &Transport{DisableHeuristicFreshness: true}
+	clock = &fakeClock{}
+	if tp.getFreshness(resp, entryMeta{}, req) != stale {
+		t.Fatal("freshness isn't stale")
+	}
+}
+
 func containsHeader(headers []string, header string) bool {
 	for _, v := range headers {
 		if http.CanonicalHeaderKey(v) == http.CanonicalHeaderKey(header) {
@@ -1192,6 +1631,130 @@ func (t transportMock) RoundTrip(req *http.Request) (resp *http.Response, err er
 	return t.response, t.err
 }
 
+// fakeURL is the URL requested by fetch when none is given.
+const fakeURL = "http://somewhere.com/"
+
+// fakeTransport answers requests as a server of the representation body would, honoring
+// conditional and Range requests, and records them. Its responses carry the entity tag
+// "abc", the Content-Type text/plain and the Cache-Control max-age=3600, unless set
+// otherwise in header.
+type fakeTransport struct {
+	// header holds fields set in the responses.
+	header http.Header
+	// body is the representation served, "some data" if empty.
+	body string
+	// chunked sends responses without a Content-Length.
+	chunked bool
+	// respond, if not nil, answers the requests instead, usually by calling serve.
+	respond func(req *http.Request) (*http.Response, error)
+	// release, if not nil, holds the requests until it is closed.
+	release chan struct{}
+	// failures is the number of requests, the first ones, failing with an error.
+	failures int
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (ft *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ft.mu.Lock()
+	ft.requests = append(ft.requests, req)
+	fail := len(ft.requests) <= ft.failures
+	release := ft.release
+	ft.mu.Unlock()
+
+	if release != nil {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if fail {
+		return nil, errors.New("some error")
+	}
+	if ft.respond != nil {
+		return ft.respond(req)
+	}
+	body := ft.body
+	if body == "" {
+		body = "some data"
+	}
+	return ft.serve(req, `"abc"`, body), nil
+}
+
+// serve returns the response to req serving body with the entity tag etag.
+func (ft *fakeTransport) serve(req *http.Request, etag, body string) *http.Response {
+	w := httptest.NewRecorder()
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Etag", etag)
+	for field, values := range ft.header {
+		w.Header()[field] = values
+	}
+	http.ServeContent(w, req, "", time.Time{}, strings.NewReader(body))
+	resp := w.Result()
+	if ft.chunked {
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+// count returns the number of requests received.
+func (ft *fakeTransport) count() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return len(ft.requests)
+}
+
+// request returns the i-th request received.
+func (ft *fakeTransport) request(i int) *http.Request {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.requests[i]
+}
+
+// fetch sends a GET request for u, or fakeURL if empty, through tp, with the header fields
+// given as pairs of names and values; fields with an empty value are not sent. It returns
+// the response, with its body read.
+func fetch(t *testing.T, tp http.RoundTripper, u string, fields ...string) (*http.Response, string) {
+	if u == "" {
+		u = fakeURL
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] != "" {
+			req.Header.Set(fields[i], fields[i+1])
+		}
+	}
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+// bookkeepingHeader returns the name of a field of h used to store bookkeeping data along
+// with a response, or "" if there is none.
+func bookkeepingHeader(h http.Header) string {
+	for name := range h {
+		if strings.HasPrefix(name, "X-Httpcache-") || strings.HasPrefix(name, variedHeaderPrefix) {
+			return name
+		}
+	}
+	return ""
+}
+
 func TestStaleIfErrorRequest(t *testing.T) {
 	resetTest()
 	now := time.Now()
@@ -1473,3 +2036,152 @@ func TestClientTimeout(t *testing.T) {
 		t.Error("client.Do took 2+ seconds, want < 2 seconds")
 	}
 }
+
+func TestFieldQualifiedDirectives(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", `max-age=3600, no-cache="Set-Cookie", private="Authorization-Info"`)
+		header.Set("Set-Cookie", "session=1")
+		header.Set("Authorization-Info", "nextnonce=abc")
+		header.Set("X-Kept", "1")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	}}
+	for _, shared := range []bool{false, true} {
+		tp := NewMemoryCacheTransport()
+		tp.Transport = upstream
+		tp.Shared = shared
+		get := func() *http.Response {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			resp, err := tp.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return resp
+		}
+
+		resp := get()
+		if resp.Header.Get("Set-Cookie") == "" || resp.Header.Get("Authorization-Info") == "" {
+			t.Fatalf("shared %v: fields were stripped from the response from the server", shared)
+		}
+		resp = get()
+		if resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf("shared %v: response wasn't served fresh from the cache", shared)
+		}
+		if resp.Header.Get("Set-Cookie") != "" {
+			t.Errorf("shared %v: no-cache field was served from the cache", shared)
+		}
+		if got := resp.Header.Get("Authorization-Info") != ""; got == shared {
+			t.Errorf("shared %v: private field served from the cache: %v", shared, got)
+		}
+		if resp.Header.Get("X-Kept") != "1" {
+			t.Errorf("shared %v: other fields weren't kept", shared)
+		}
+	}
+}
+
+func TestParseHTTPDate(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+		" Sun, 06 Nov 1994 08:49:37 GMT ",
+		"Sun, 6 Nov 1994 08:49:37 GMT",
+		"Sun, 06 Nov 1994 09:49:37 +0100",
+		"Sunday, 06-Nov-1994 08:49:37 GMT",
+	} {
+		got, err := ParseHTTPDate(value)
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+		} else if !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("%q: got %v, want %v", value, got, want)
+		}
+	}
+	for _, value := range []string{"", "0", "-1", "yesterday", "2006-01-02T15:04:05Z"} {
+		if _, err := ParseHTTPDate(value); err == nil {
+			t.Errorf("%q: got no error", value)
+		}
+	}
+}
+
+func TestExpiresFormats(t *testing.T) {
+	resetTest()
+	now := time.Now().UTC()
+	tests := []struct {
+		date, expires string
+		want          int
+	}{
+		{now.Format(time.RFC850), now.Add(time.Hour).Format(time.RFC850), fresh},
+		{now.Format(time.ANSIC), now.Add(time.Hour).Format(time.ANSIC), fresh},
+		{now.Format(http.TimeFormat), now.Add(time.Hour).Format(time.RFC1123Z), fresh},
+		{now.Format(http.TimeFormat), now.Add(-time.Hour).Format(http.TimeFormat), stale},
+		{now.Format(http.TimeFormat), "0", stale},
+		{now.Format(http.TimeFormat), "-1", stale},
+	}
+	for _, test := range tests {
+		respHeaders := http.Header{"Date": {test.date}, "Expires": {test.expires}}
+		if got := getFreshness(respHeaders, http.Header{}); got != test.want {
+			t.Errorf("Date %q, Expires %q: got freshness %d, want %d", test.date, test.expires, got, test.want)
+		}
+	}
+}
+
+func TestMaxCacheableBodySize(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.MaxCacheableBodySize = 10
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		body := strings.Repeat("x", len(req.URL.Path))
+		contentLength := int64(len(body))
+		if req.URL.Query().Get("length") == "unknown" {
+			contentLength = -1
+		}
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=3600")
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			ContentLength: contentLength,
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	}}
+
+	tests := []struct {
+		url      string
+		buffered bool
+		stored   bool
+	}{
+		{"http://example.com/short", true, true},
+		{"http://example.com/ninechars", true, true},
+		{"http://example.com/eleven-long", false, false},
+		{"http://example.com/short?length=unknown", true, true},
+		{"http://example.com/eleven-long?length=unknown", true, false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp.Body.(*cachingReadCloser); ok != test.buffered {
+			t.Errorf("%s: got body buffered %v, want %v", test.url, ok, test.buffered)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || len(body) != len(req.URL.Path) {
+			t.Errorf("%s: got body %q, %v", test.url, body, err)
+		}
+		if _, ok := tp.Cache.Get(cacheKey(req)); ok != test.stored {
+			t.Errorf("%s: got stored %v, want %v", test.url, ok, test.stored)
+		}
+	}
+}
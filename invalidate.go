@@ -0,0 +1,61 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isSafeMethod returns true if method is safe, see
+// https://tools.ietf.org/html/rfc9110#section-9.2.1
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// invalidate removes the cached responses made stale by the successful unsafe request
+// req: the ones for its URL, for the same-origin URLs in the Location and
+// Content-Location headers of resp, and for the keys returned by InvalidateKeys. See
+// https://tools.ietf.org/html/rfc9111#section-4.4
+func (t *Transport) invalidate(req *http.Request, resp *http.Response) {
+	ctx := req.Context()
+	t.invalidateURL(ctx, req.URL)
+	for _, header := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		u, err := req.URL.Parse(value)
+		if err != nil || !sameOrigin(u, req.URL) {
+			continue
+		}
+		t.invalidateURL(ctx, u)
+	}
+	if t.InvalidateKeys != nil {
+		for _, key := range t.InvalidateKeys(req, resp) {
+			t.deleteEntry(ctx, key)
+			t.cacheDelete(ctx, partialKey(key))
+		}
+	}
+}
+
+// invalidateURL removes the responses to GET and HEAD requests for u from the cache, with
+// all of their variants.
+func (t *Transport) invalidateURL(ctx context.Context, u *url.URL) {
+	for _, method := range []string{"GET", "HEAD"} {
+		key := t.key(&http.Request{Method: method, URL: u, Header: http.Header{}, Host: u.Host})
+		t.deleteEntry(ctx, key)
+		if method == "GET" {
+			t.cacheDelete(ctx, partialKey(key))
+		}
+	}
+}
+
+// sameOrigin returns true if u1 and u2 have the same scheme, host and port.
+func sameOrigin(u1, u2 *url.URL) bool {
+	return strings.EqualFold(u1.Scheme, u2.Scheme) && strings.EqualFold(u1.Host, u2.Host)
+}
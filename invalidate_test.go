@@ -0,0 +1,92 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInvalidateAfterUnsafeMethod(t *testing.T) {
+	resetTest()
+	putStatus := http.StatusOK
+	upstream := &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		status := http.StatusOK
+		if req.Method == "PUT" {
+			status = putStatus
+			header.Set("Location", "/items/2")
+			header.Set("Content-Location", "http://elsewhere.com/items/1")
+		} else {
+			header.Set("Cache-Control", "max-age=3600")
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(req.Method)),
+		}, nil
+	}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.InvalidateKeys = func(req *http.Request, resp *http.Response) []string {
+		return []string{req.URL.String() + "?expand=x"}
+	}
+
+	urls := []string{
+		"http://somewhere.com/items/1",
+		"http://somewhere.com/items/1?expand=x",
+		"http://somewhere.com/items/2",
+		"http://somewhere.com/items/3",
+		"http://elsewhere.com/items/1",
+	}
+	cacheAll := func() {
+		for _, u := range urls {
+			req, _ := http.NewRequest("GET", u, nil)
+			resp, err := tp.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+	put := func() {
+		req, _ := http.NewRequest("PUT", "http://somewhere.com/items/1", nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	cached := func(u string) bool {
+		_, ok := tp.Cache.Get(u)
+		return ok
+	}
+
+	cacheAll()
+	put()
+	want := map[string]bool{
+		"http://somewhere.com/items/1":          false,
+		"http://somewhere.com/items/1?expand=x": false,
+		"http://somewhere.com/items/2":          false,
+		"http://somewhere.com/items/3":          true,
+		"http://elsewhere.com/items/1":          true,
+	}
+	for u, w := range want {
+		if got := cached(u); got != w {
+			t.Errorf("%s: got cached %v, want %v", u, got, w)
+		}
+	}
+
+	// Failed requests don't invalidate anything
+	cacheAll()
+	putStatus = http.StatusConflict
+	put()
+	for _, u := range urls {
+		if !cached(u) {
+			t.Errorf("%s: invalidated after a failed request", u)
+		}
+	}
+}
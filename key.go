@@ -0,0 +1,84 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NormalizedKey returns a function, to be used as the KeyFunc of a Transport, that
+// computes the default cache key of a request after applying the given normalizations to
+// a copy of its URL. For example, with
+//
+//	t.KeyFunc = httpcache.NormalizedKey(httpcache.SortQuery, httpcache.DropQueryParams("sid"))
+//
+// requests for URLs that differ only by the order of their query parameters, or by their
+// sid parameter, share the same cached responses.
+func NormalizedKey(normalizations ...func(u *url.URL)) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		u := *req.URL
+		for _, normalize := range normalizations {
+			normalize(&u)
+		}
+		return cacheKey(&http.Request{Method: req.Method, URL: &u})
+	}
+}
+
+// SortQuery sorts the query parameters of u by name. The values of a parameter keep
+// their order, and the parameters keep their encoding, so that those that can't be parsed
+// still tell URLs apart.
+func SortQuery(u *url.URL) {
+	if u.RawQuery == "" {
+		return
+	}
+	params := strings.Split(u.RawQuery, "&")
+	sort.SliceStable(params, func(i, j int) bool {
+		return queryParamName(params[i]) < queryParamName(params[j])
+	})
+	u.RawQuery = strings.Join(params, "&")
+}
+
+// queryParamName returns the name of the raw query parameter param, unescaped if it can
+// be.
+func queryParamName(param string) string {
+	name := param
+	if i := strings.IndexByte(name, '='); i >= 0 {
+		name = name[:i]
+	}
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+	return name
+}
+
+// DropQueryParams returns a normalization removing the query parameters with the given
+// names, such as session tracking parameters, from URLs.
+func DropQueryParams(names ...string) func(u *url.URL) {
+	drop := make(map[string]bool, len(names))
+	for _, name := range names {
+		drop[name] = true
+	}
+	return func(u *url.URL) {
+		if u.RawQuery == "" {
+			return
+		}
+		var kept []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			if !drop[queryParamName(param)] {
+				kept = append(kept, param)
+			}
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+}
+
+// LowercaseHost converts the host of u to lowercase, as host names are case-insensitive.
+func LowercaseHost(u *url.URL) {
+	u.Host = strings.ToLower(u.Host)
+}
+
+// StripFragment removes the fragment of u, which is never sent to servers.
+func StripFragment(u *url.URL) {
+	u.Fragment = ""
+}
@@ -0,0 +1,76 @@
+package httpcache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNormalizedKey(t *testing.T) {
+	key := NormalizedKey(SortQuery, DropQueryParams("sid", "utm source"), LowercaseHost, StripFragment)
+	tests := []struct {
+		method, url, want string
+	}{
+		{"GET", "http://example.com/a", "http://example.com/a"},
+		{"GET", "http://Example.COM/a?b=2&a=1&a=0", "http://example.com/a?a=1&a=0&b=2"},
+		{"GET", "http://example.com/a?sid=123&b=2&utm+source=x", "http://example.com/a?b=2"},
+		{"GET", "http://example.com/a?sid=123", "http://example.com/a"},
+		{"GET", "http://example.com/a?id=%zz1", "http://example.com/a?id=%zz1"},
+		{"GET", "http://example.com/a?id=%zz2&b=1", "http://example.com/a?b=1&id=%zz2"},
+		{"GET", "http://example.com/a#top", "http://example.com/a"},
+		{"HEAD", "http://example.com/a?sid=1", "HEAD http://example.com/a"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := key(req); got != test.want {
+			t.Errorf("%s %s: got key %q, want %q", test.method, test.url, got, test.want)
+		}
+		if req.URL.String() != test.url {
+			t.Errorf("%s %s: request URL was modified: %s", test.method, test.url, req.URL)
+		}
+	}
+}
+
+func TestDropQueryParamsKeepsOrder(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/?z=1&sid=2&a=3", nil)
+	if got := NormalizedKey(DropQueryParams("sid"))(req); got != "http://example.com/?z=1&a=3" {
+		t.Fatalf("got key %q", got)
+	}
+}
+
+func TestTransportKeyFunc(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{}
+	tp := NewMemoryCacheTransport()
+	tp.KeyFunc = NormalizedKey(DropQueryParams("sid"))
+	tp.Transport = upstream
+
+	for _, u := range []string{"http://example.com/?sid=1", "http://example.com/?sid=2"} {
+		fetch(t, tp, u)
+	}
+	if upstream.count() != 1 {
+		t.Fatalf("got %d upstream requests, want 1", upstream.count())
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/?sid=3", nil)
+	resp, err := tp.CachedResponse(req)
+	if err != nil || resp == nil {
+		t.Fatalf("got %v, %v from Transport.CachedResponse; want the cached response", resp, err)
+	}
+	if _, ok := tp.Cache.Get("http://example.com/"); !ok {
+		t.Fatal("response wasn't stored under the normalized key")
+	}
+
+	// Invalidation uses the same keys
+	req, _ = http.NewRequest("POST", "http://example.com/?sid=4", nil)
+	resp, err = tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, ok := tp.Cache.Get("http://example.com/"); ok {
+		t.Fatal("response wasn't invalidated")
+	}
+}
@@ -3,32 +3,330 @@
 package leveldbcache
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gregjones/httpcache"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-// Cache is an implementation of httpcache.Cache with leveldb storage
+// chunkSize is the size of the chunks in which the responses written with Create are
+// stored, so that they are never held in memory in full. Smaller responses are stored as a
+// single value, like with Set.
+const chunkSize = 1 << 20
+
+// chunksPrefix starts the value stored under the key of a response written in chunks. It
+// is followed by the id of the write and the number of chunks.
+const chunksPrefix = "\x00leveldbcache chunks "
+
+// Cache is an implementation of httpcache.Cache, httpcache.ContextCache and
+// httpcache.ContextStreamingCache with leveldb storage
 type Cache struct {
 	db *leveldb.DB
+
+	// mu serializes the replacement of values, and guards writing, the ids of the writes
+	// in progress whose chunks must be kept.
+	mu      sync.Mutex
+	writing map[string]bool
+}
+
+var _ httpcache.ContextStreamingCache = (*Cache)(nil)
+
+// chunkPrefix returns the prefix of the keys of the chunks of the responses stored under
+// key.
+func chunkPrefix(key string) string {
+	return "\x00leveldbcache chunk " + key + "\x00"
+}
+
+// chunkKey returns the key of the i-th chunk of the response stored under key by the
+// write with the given id.
+func chunkKey(key, id string, i int) []byte {
+	return []byte(fmt.Sprintf("%s%s %08x", chunkPrefix(key), id, i))
+}
+
+// parseChunks returns the id of the write and the number of chunks of the response written
+// in chunks whose value is v, and false if v holds a response.
+func parseChunks(v []byte) (id string, n int, ok bool) {
+	if !bytes.HasPrefix(v, []byte(chunksPrefix)) {
+		return "", 0, false
+	}
+	fields := strings.Fields(string(v[len(chunksPrefix):]))
+	if len(fields) != 2 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 {
+		return "", 0, false
+	}
+	return fields[0], n, true
 }
 
 // Get returns the response corresponding to key if present
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	var err error
-	resp, err = c.db.Get([]byte(key), nil)
+	resp, ok, _ = c.GetContext(context.Background(), key)
+	return resp, ok
+}
+
+// GetContext returns the response corresponding to key if present. Failing to read it is
+// an error, unlike it being missing.
+func (c *Cache) GetContext(ctx context.Context, key string) (resp []byte, ok bool, err error) {
+	r, ok, err := c.OpenContext(ctx, key)
+	if !ok {
+		return []byte{}, false, err
+	}
+	defer r.Close()
+	resp, err = ioutil.ReadAll(r)
 	if err != nil {
-		return []byte{}, false
+		return []byte{}, false, err
 	}
-	return resp, true
+	return resp, true, nil
+}
+
+// Open returns a reader for the response corresponding to key if present. Responses
+// written in chunks are read one chunk at a time.
+func (c *Cache) Open(key string) (io.ReadCloser, bool) {
+	r, ok, _ := c.OpenContext(context.Background(), key)
+	return r, ok
+}
+
+// OpenContext returns a reader for the response corresponding to key if present, like
+// Open. Failing to open it is an error, unlike it being missing.
+func (c *Cache) OpenContext(ctx context.Context, key string) (io.ReadCloser, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	// The chunks are read from a snapshot, so that replacing the response doesn't affect
+	// readers
+	snap, err := c.db.GetSnapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	v, err := snap.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		snap.Release()
+		return nil, false, nil
+	} else if err != nil {
+		snap.Release()
+		return nil, false, err
+	}
+	id, n, ok := parseChunks(v)
+	if !ok {
+		snap.Release()
+		return ioutil.NopCloser(bytes.NewReader(v)), true, nil
+	}
+	return &chunkReader{snap: snap, key: key, id: id, n: n}, true, nil
+}
+
+// chunkReader reads the chunks of a response from a snapshot.
+type chunkReader struct {
+	snap  *leveldb.Snapshot
+	key   string
+	id    string
+	n     int // number of chunks
+	i     int // next chunk to read
+	chunk []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.i == r.n {
+			return 0, io.EOF
+		}
+		chunk, err := r.snap.Get(chunkKey(r.key, r.id, r.i), nil)
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = chunk
+		r.i++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Close releases the snapshot read.
+func (r *chunkReader) Close() error {
+	r.snap.Release()
+	return nil
 }
 
 // Set saves a response to the cache as key
 func (c *Cache) Set(key string, resp []byte) {
-	c.db.Put([]byte(key), resp, nil)
+	c.SetContext(context.Background(), key, resp)
+}
+
+// SetContext saves a response to the cache as key
+func (c *Cache) SetContext(ctx context.Context, key string, resp []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.replace(key, "", func(batch *leveldb.Batch) {
+		batch.Put([]byte(key), resp)
+	})
+}
+
+// Create returns a writer saving a response to the cache as key once closed. The response
+// is written in chunks as it is written, and replaces the one stored under key once the
+// writer is closed. Calling Abort instead discards it.
+func (c *Cache) Create(key string) (io.WriteCloser, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	w := &writer{c: c, key: key, id: hex.EncodeToString(b)}
+	c.mu.Lock()
+	if c.writing == nil {
+		c.writing = map[string]bool{}
+	}
+	c.writing[w.id] = true
+	c.mu.Unlock()
+	return w, nil
+}
+
+// replace deletes the chunks stored for key, except those of the writes in progress and of
+// the write with the given id, and applies put in the same batch. That write is then no
+// longer in progress.
+func (c *Cache) replace(key, id string, put func(batch *leveldb.Batch)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.writing, id)
+	batch := new(leveldb.Batch)
+	prefix := chunkPrefix(key)
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		rest := string(iter.Key()[len(prefix):])
+		if strings.Contains(rest, "\x00") {
+			// A chunk of another key, which key is a prefix of
+			continue
+		}
+		if chunkID := strings.SplitN(rest, " ", 2)[0]; chunkID != id && !c.writing[chunkID] {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	put(batch)
+	return c.db.Write(batch, nil)
+}
+
+// errClosed is returned when writing to a writer which was closed or aborted.
+var errClosed = errors.New("leveldbcache: writer closed")
+
+// writer stores a response in chunks as it is written.
+type writer struct {
+	c      *Cache
+	key    string
+	id     string
+	buf    []byte
+	n      int // number of chunks stored
+	err    error
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= chunkSize {
+		if w.err = w.flush(chunkSize); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// flush stores the first size bytes written as the next chunk.
+func (w *writer) flush(size int) error {
+	if err := w.c.db.Put(chunkKey(w.key, w.id, w.n), w.buf[:size], nil); err != nil {
+		return err
+	}
+	w.n++
+	w.buf = append(w.buf[:0], w.buf[size:]...)
+	return nil
+}
+
+// Close saves the response written to the cache, replacing the one stored under its key.
+func (w *writer) Close() error {
+	if w.closed {
+		return errClosed
+	}
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	if w.n > 0 && len(w.buf) > 0 {
+		if err := w.flush(len(w.buf)); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.closed = true
+	value := w.buf
+	if w.n > 0 {
+		value = []byte(fmt.Sprintf("%s%s %d", chunksPrefix, w.id, w.n))
+	} else if value == nil {
+		value = []byte{}
+	}
+	err := w.c.replace(w.key, w.id, func(batch *leveldb.Batch) {
+		batch.Put([]byte(w.key), value)
+	})
+	if err != nil {
+		w.deleteChunks()
+	}
+	return err
+}
+
+// Abort discards the response written, leaving the cache untouched.
+func (w *writer) Abort() error {
+	if w.closed {
+		return errClosed
+	}
+	w.closed = true
+	w.c.mu.Lock()
+	delete(w.c.writing, w.id)
+	w.c.mu.Unlock()
+	return w.deleteChunks()
+}
+
+// deleteChunks deletes the chunks stored by w.
+func (w *writer) deleteChunks() error {
+	batch := new(leveldb.Batch)
+	for i := 0; i < w.n; i++ {
+		batch.Delete(chunkKey(w.key, w.id, i))
+	}
+	w.buf = nil
+	return w.c.db.Write(batch, nil)
 }
 
 // Delete removes the response with key from the cache
 func (c *Cache) Delete(key string) {
-	c.db.Delete([]byte(key), nil)
+	c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes the response with key from the cache
+func (c *Cache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.replace(key, "", func(batch *leveldb.Batch) {
+		batch.Delete([]byte(key))
+	})
 }
 
 // New returns a new Cache that will store leveldb in path
@@ -47,5 +345,5 @@ func New(path string) (*Cache, error) {
 // NewWithDB returns a new Cache using the provided leveldb as underlying
 // storage.
 func NewWithDB(db *leveldb.DB) *Cache {
-	return &Cache{db}
+	return &Cache{db: db}
 }
@@ -1,12 +1,14 @@
 package leveldbcache
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/gregjones/httpcache/test"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 func TestDiskCache(t *testing.T) {
@@ -21,5 +23,97 @@ func TestDiskCache(t *testing.T) {
 		t.Fatalf("New leveldb,: %v", err)
 	}
 
-	test.Cache(t, cache)
+	test.StreamingCache(t, cache)
+	test.ContextCache(t, cache)
+}
+
+func TestDiskCacheChunks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := New(filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatalf("New leveldb,: %v", err)
+	}
+
+	create := func(value []byte) {
+		w, err := cache.Create("key")
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		// Written in uneven pieces, so that chunks span several writes
+		for len(value) > 0 {
+			n := 300000
+			if n > len(value) {
+				n = len(value)
+			}
+			if _, err := w.Write(value[:n]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			value = value[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	chunks := func() int {
+		iter := cache.db.NewIterator(util.BytesPrefix([]byte(chunkPrefix("key"))), nil)
+		defer iter.Release()
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		return n
+	}
+
+	first := bytes.Repeat([]byte("0123456789"), chunkSize/4)
+	create(first)
+	if n := chunks(); n != 3 {
+		t.Fatalf("%d chunks stored for %d bytes, want 3", n, len(first))
+	}
+	// A reader keeps reading the value it opened after it is replaced
+	r, ok := cache.Open("key")
+	if !ok {
+		t.Fatal("value written in chunks is missing")
+	}
+	second := bytes.Repeat([]byte("abcdefghij"), chunkSize/5)
+	create(second)
+	if n := chunks(); n != 2 {
+		t.Fatalf("%d chunks stored after replacing the value, want 2", n)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("read %d bytes, %v from the replaced value, want %d bytes", len(got), err, len(first))
+	}
+	if got, ok := cache.Get("key"); !ok || !bytes.Equal(got, second) {
+		t.Fatalf("got %d bytes, %v, want %d bytes", len(got), ok, len(second))
+	}
+
+	// An aborted write leaves no chunks behind
+	w, err := cache.Create("key")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w.Write(first)
+	w.(interface{ Abort() error }).Abort()
+	if n := chunks(); n != 2 {
+		t.Fatalf("%d chunks stored after an aborted write, want 2", n)
+	}
+
+	cache.Set("key", []byte("small"))
+	if n := chunks(); n != 0 {
+		t.Fatalf("%d chunks stored after replacing the value with Set, want 0", n)
+	}
+	if got, ok := cache.Get("key"); !ok || string(got) != "small" {
+		t.Fatalf("got %q, %v, want small", got, ok)
+	}
+	create(second)
+	cache.Delete("key")
+	if _, ok := cache.Get("key"); ok || chunks() != 0 {
+		t.Fatalf("value or chunks left after Delete")
+	}
 }
@@ -9,12 +9,16 @@
 package memcache
 
 import (
+	"context"
+
 	"appengine"
 	"appengine/memcache"
 )
 
-// Cache is an implementation of httpcache.Cache that caches responses in App
-// Engine's memcache.
+// Cache is an implementation of httpcache.Cache and httpcache.ContextCache that
+// caches responses in App Engine's memcache. The App Engine context it was created
+// with is used for all operations; the contexts passed to the ContextCache methods
+// only stop them from starting once done.
 type Cache struct {
 	appengine.Context
 }
@@ -27,34 +31,66 @@ func cacheKey(key string) string {
 
 // Get returns the response corresponding to key if present.
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	item, err := memcache.Get(c.Context, cacheKey(key))
+	resp, ok, err := c.GetContext(context.Background(), key)
 	if err != nil {
-		if err != memcache.ErrCacheMiss {
-			c.Context.Errorf("error getting cached response: %v", err)
-		}
-		return nil, false
+		c.Context.Errorf("error getting cached response: %v", err)
 	}
-	return item.Value, true
+	return resp, ok
+}
+
+// GetContext returns the response corresponding to key if present. Failing to get
+// it is an error, unlike it being missing.
+func (c *Cache) GetContext(ctx context.Context, key string) (resp []byte, ok bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	item, err := memcache.Get(c.Context, cacheKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return item.Value, true, nil
 }
 
 // Set saves a response to the cache as key.
 func (c *Cache) Set(key string, resp []byte) {
+	if err := c.SetContext(context.Background(), key, resp); err != nil {
+		c.Context.Errorf("error caching response: %v", err)
+	}
+}
+
+// SetContext saves a response to the cache as key.
+func (c *Cache) SetContext(ctx context.Context, key string, resp []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	item := &memcache.Item{
 		Key:   cacheKey(key),
 		Value: resp,
 	}
-	if err := memcache.Set(c.Context, item); err != nil {
-		c.Context.Errorf("error caching response: %v", err)
-	}
+	return memcache.Set(c.Context, item)
 }
 
 // Delete removes the response with key from the cache.
 func (c *Cache) Delete(key string) {
-	if err := memcache.Delete(c.Context, cacheKey(key)); err != nil {
+	if err := c.DeleteContext(context.Background(), key); err != nil {
 		c.Context.Errorf("error deleting cached response: %v", err)
 	}
 }
 
+// DeleteContext removes the response with key from the cache.
+func (c *Cache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := memcache.Delete(c.Context, cacheKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
 // New returns a new Cache for the given context.
 func New(ctx appengine.Context) *Cache {
 	return &Cache{ctx}
@@ -17,4 +17,5 @@ func TestAppEngine(t *testing.T) {
 	defer ctx.Close()
 
 	test.Cache(t, New(ctx))
+	test.ContextCache(t, New(ctx))
 }
@@ -9,11 +9,13 @@
 package memcache
 
 import (
+	"context"
+
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
-// Cache is an implementation of httpcache.Cache that caches responses in a
-// memcache server.
+// Cache is an implementation of httpcache.Cache and httpcache.ContextCache that
+// caches responses in a memcache server.
 type Cache struct {
 	*memcache.Client
 }
@@ -24,27 +26,79 @@ func cacheKey(key string) string {
 	return "httpcache:" + key
 }
 
+// run calls f, but returns early with the error of ctx if it is done first. f then
+// goes on in the background, for up to the Timeout of the client.
+func run(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Get returns the response corresponding to key if present.
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
-	item, err := c.Client.Get(cacheKey(key))
-	if err != nil {
-		return nil, false
+	resp, ok, _ = c.GetContext(context.Background(), key)
+	return resp, ok
+}
+
+// GetContext returns the response corresponding to key if present. Failing to get
+// it is an error, unlike it being missing.
+func (c *Cache) GetContext(ctx context.Context, key string) (resp []byte, ok bool, err error) {
+	var item *memcache.Item
+	err = run(ctx, func() (err error) {
+		item, err = c.Client.Get(cacheKey(key))
+		return err
+	})
+	if err == memcache.ErrCacheMiss {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
 	}
-	return item.Value, true
+	return item.Value, true, nil
 }
 
 // Set saves a response to the cache as key.
 func (c *Cache) Set(key string, resp []byte) {
+	c.SetContext(context.Background(), key, resp)
+}
+
+// SetContext saves a response to the cache as key.
+func (c *Cache) SetContext(ctx context.Context, key string, resp []byte) error {
 	item := &memcache.Item{
 		Key:   cacheKey(key),
 		Value: resp,
 	}
-	c.Client.Set(item)
+	return run(ctx, func() error {
+		return c.Client.Set(item)
+	})
 }
 
 // Delete removes the response with key from the cache.
 func (c *Cache) Delete(key string) {
-	c.Client.Delete(cacheKey(key))
+	c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes the response with key from the cache.
+func (c *Cache) DeleteContext(ctx context.Context, key string) error {
+	err := run(ctx, func() error {
+		return c.Client.Delete(cacheKey(key))
+	})
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
 }
 
 // New returns a new Cache using the provided memcache server(s) with equal
@@ -20,5 +20,7 @@ func TestMemCache(t *testing.T) {
 	conn.Write([]byte("flush_all\r\n")) // flush memcache
 	conn.Close()
 
-	test.Cache(t, New(testServer))
+	cache := New(testServer)
+	test.Cache(t, cache)
+	test.ContextCache(t, cache)
 }
@@ -0,0 +1,51 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RequestOptions change how a Transport handles a single request, without changing the
+// request sent to the server. They are attached to the context of the request with
+// WithRequestOptions.
+type RequestOptions struct {
+	// If true, the request is forwarded without looking for a cached response. The response
+	// is still stored, unless SkipStore is set.
+	SkipLookup bool
+	// If true, the response is not stored, and the cached responses are left untouched.
+	SkipStore bool
+	// If true, a cached response is only used once revalidated with the server, even if it
+	// is fresh.
+	Revalidate bool
+	// FreshnessLifetime, if not zero, is used in place of the freshness lifetime of the cached
+	// response, for example to keep using it for longer than the server asked.
+	FreshnessLifetime time.Duration
+	// If true, the request is never forwarded: a cached response is returned whatever its
+	// freshness, or a 504 Gateway Timeout response if there is none, as with the
+	// only-if-cached request directive.
+	OnlyIfCached bool
+}
+
+type requestOptionsKey struct{}
+
+// WithRequestOptions returns a copy of ctx carrying opts, which apply to the requests made
+// with the returned context.
+//
+//	ctx := httpcache.WithRequestOptions(req.Context(), httpcache.RequestOptions{Revalidate: true})
+//	resp, err := client.Do(req.WithContext(ctx))
+func WithRequestOptions(ctx context.Context, opts RequestOptions) context.Context {
+	return context.WithValue(ctx, requestOptionsKey{}, opts)
+}
+
+// requestOptions returns the options attached to the context of req.
+func requestOptions(req *http.Request) RequestOptions {
+	opts, _ := req.Context().Value(requestOptionsKey{}).(RequestOptions)
+	return opts
+}
+
+// onlyIfCached returns true if req may only be served from the cache.
+func onlyIfCached(req *http.Request) bool {
+	_, ok := ParseCacheControl(req.Header)["only-if-cached"]
+	return ok || requestOptions(req).OnlyIfCached
+}
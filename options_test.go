@@ -0,0 +1,83 @@
+package httpcache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestOptions(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=1"}}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	get := func(u string, opts RequestOptions) *http.Response {
+		req, _ := http.NewRequest("GET", u, nil)
+		req = req.WithContext(WithRequestOptions(context.Background(), opts))
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	stored := func(u string) bool {
+		_, ok := tp.Cache.Get(u)
+		return ok
+	}
+
+	// SkipStore
+	get("http://example.com/a", RequestOptions{SkipStore: true})
+	if stored("http://example.com/a") {
+		t.Fatal("response was stored with SkipStore")
+	}
+
+	// OnlyIfCached
+	if resp := get("http://example.com/a", RequestOptions{OnlyIfCached: true}); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("got status %d with OnlyIfCached and nothing cached, want 504", resp.StatusCode)
+	}
+	if upstream.count() != 1 {
+		t.Fatalf("request was forwarded with OnlyIfCached")
+	}
+
+	// SkipLookup forwards the request, and stores the response
+	get("http://example.com/a", RequestOptions{})
+	n := upstream.count()
+	if resp := get("http://example.com/a", RequestOptions{SkipLookup: true}); resp.Header.Get(XFromCache) != "" {
+		t.Fatal("response came from the cache with SkipLookup")
+	}
+	if upstream.count() != n+1 || upstream.request(n).Header.Get("if-none-match") != "" {
+		t.Fatal("request wasn't forwarded unconditionally with SkipLookup")
+	}
+
+	// Revalidate
+	resp := get("http://example.com/a", RequestOptions{Revalidate: true})
+	if upstream.count() != n+2 || upstream.request(n+1).Header.Get("if-none-match") != `"abc"` {
+		t.Fatal("fresh response wasn't revalidated with Revalidate")
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("revalidated response wasn't served from the cache")
+	}
+
+	// OnlyIfCached wins over Revalidate
+	if resp := get("http://example.com/a", RequestOptions{OnlyIfCached: true, Revalidate: true}); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("cached response wasn't served with OnlyIfCached and Revalidate")
+	}
+	if upstream.count() != n+2 {
+		t.Fatal("request was forwarded with OnlyIfCached and Revalidate")
+	}
+
+	// FreshnessLifetime
+	clock = &fakeClock{elapsed: time.Hour}
+	get("http://example.com/a", RequestOptions{FreshnessLifetime: 2 * time.Hour})
+	if upstream.count() != n+2 {
+		t.Fatal("request was forwarded with a longer FreshnessLifetime")
+	}
+	get("http://example.com/a", RequestOptions{})
+	if upstream.count() != n+3 {
+		t.Fatal("stale response was served without FreshnessLifetime")
+	}
+}
@@ -0,0 +1,353 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialKey returns the key under which the known parts of the response to the request
+// with cache key are stored, until all of it is known.
+func partialKey(key string) string {
+	return "partial " + key
+}
+
+// contentPart is a known part of a representation, starting at offset start.
+type contentPart struct {
+	start int64
+	data  []byte
+}
+
+func (p contentPart) end() int64 {
+	return p.start + int64(len(p.data))
+}
+
+// partialContent holds the known parts of a representation of size bytes. It is stored
+// as an entry holding a 206 response with a multipart/byteranges body.
+type partialContent struct {
+	// header holds the headers of the most recent response, without the ones describing
+	// its content range, and meta its metadata.
+	header http.Header
+	meta   entryMeta
+	size   int64
+	// parts are sorted by start, and neither overlap nor are contiguous.
+	parts []contentPart
+}
+
+// add merges the bytes data, starting at offset start, into the known parts.
+func (p *partialContent) add(start int64, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	merged := contentPart{start, data}
+	var parts []contentPart
+	for _, part := range p.parts {
+		if part.end() < merged.start || part.start > merged.end() {
+			parts = append(parts, part)
+			continue
+		}
+		// The parts overlap or are contiguous: the new data wins where they overlap.
+		start := merged.start
+		if part.start < start {
+			start = part.start
+		}
+		end := merged.end()
+		if part.end() > end {
+			end = part.end()
+		}
+		buf := make([]byte, end-start)
+		copy(buf[part.start-start:], part.data)
+		copy(buf[merged.start-start:], merged.data)
+		merged = contentPart{start, buf}
+	}
+	parts = append(parts, merged)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].start < parts[j].start })
+	p.parts = parts
+}
+
+// complete reports whether the whole representation is known.
+func (p *partialContent) complete() bool {
+	return len(p.parts) == 1 && p.parts[0].start == 0 && int64(len(p.parts[0].data)) == p.size
+}
+
+// slice returns the length bytes starting at offset start, if they are known.
+func (p *partialContent) slice(start, length int64) ([]byte, bool) {
+	for _, part := range p.parts {
+		if part.start <= start && start+length <= part.end() {
+			return part.data[start-part.start : start-part.start+length], true
+		}
+	}
+	return nil, false
+}
+
+// sameRepresentation returns true if respHeaders describe a response carrying parts of
+// the same representation as p, as identified by a strong entity tag.
+func (p *partialContent) sameRepresentation(respHeaders http.Header, size int64) bool {
+	etag := p.header.Get("etag")
+	return size == p.size && strings.HasPrefix(etag, `"`) && respHeaders.Get("etag") == etag
+}
+
+// writeByteranges writes a multipart/byteranges body holding the given ranges of the
+// representation p to mw.
+func writeByteranges(mw *multipart.Writer, p *partialContent, ranges []httpRange) error {
+	contentType := p.header.Get("Content-Type")
+	for _, ra := range ranges {
+		data, ok := p.slice(ra.start, ra.length)
+		if !ok {
+			return errors.New("unknown range")
+		}
+		part, err := mw.CreatePart(byterangesPartHeader(contentType, ra, p.size))
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(data); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// encode returns the representation of p stored in the cache.
+func (p *partialContent) encode() ([]byte, error) {
+	ranges := make([]httpRange, len(p.parts))
+	for i, part := range p.parts {
+		ranges[i] = httpRange{part.start, int64(len(part.data))}
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := writeByteranges(mw, p, ranges); err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(p.header),
+		ContentLength: int64(body.Len()),
+		Body:          ioutil.NopCloser(&body),
+	}
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	return dumpEntry(p.meta, resp, true)
+}
+
+// decodePartialContent parses the partial content stored as b.
+func decodePartialContent(b []byte) (*partialContent, error) {
+	br := bufio.NewReader(bytes.NewReader(b))
+	m, ok, err := readEntryMeta(br)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("partial content isn't stored as an entry")
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/byteranges" {
+		return nil, fmt.Errorf("unexpected partial content type %q", mediaType)
+	}
+	p := &partialContent{header: resp.Header, meta: m}
+	p.header.Del("Content-Type")
+	p.header.Del("Content-Length")
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, _, size, err := parseContentRange(part.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		if contentType := part.Header.Get("Content-Type"); contentType != "" {
+			p.header.Set("Content-Type", contentType)
+		}
+		p.size = size
+		p.parts = append(p.parts, contentPart{start, data})
+	}
+	return p, nil
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes first-last/size".
+// Responses of unknown size are not supported.
+func parseContentRange(s string) (first, last, size int64, err error) {
+	errInvalid := fmt.Errorf("invalid content range %q", s)
+	const b = "bytes "
+	if !strings.HasPrefix(s, b) {
+		return 0, 0, 0, errInvalid
+	}
+	s = s[len(b):]
+	slash := strings.Index(s, "/")
+	dash := strings.Index(s, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, errInvalid
+	}
+	first, err1 := strconv.ParseInt(s[:dash], 10, 64)
+	last, err2 := strconv.ParseInt(s[dash+1:slash], 10, 64)
+	size, err3 := strconv.ParseInt(s[slash+1:], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || first < 0 || last < first || last >= size {
+		return 0, 0, 0, errInvalid
+	}
+	return first, last, size, nil
+}
+
+// loadPartial returns the partial content stored for the request with cache key, or nil.
+func (t *Transport) loadPartial(ctx context.Context, key string) *partialContent {
+	b, ok := t.cacheGet(ctx, partialKey(key))
+	if !ok {
+		return nil
+	}
+	p, err := decodePartialContent(b)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// storePartial records that the bytes data, starting at offset start, belong to the
+// representation of size bytes whose response headers are respHeaders, with the metadata
+// m. They are merged with the parts already known of the same representation, and once
+// all of it is known it is stored as a complete response for the request with the cache
+// key of m. Nothing is stored for representations larger than the MaxCacheableBodySize
+// of t.
+func (t *Transport) storePartial(ctx context.Context, m entryMeta, respHeaders http.Header, size, start int64, data []byte) {
+	if len(data) == 0 || !strings.HasPrefix(respHeaders.Get("etag"), `"`) ||
+		(t.MaxCacheableBodySize > 0 && size > t.MaxCacheableBodySize) {
+		return
+	}
+	header := cloneHeader(respHeaders)
+	header.Del("Content-Range")
+	header.Del("Content-Length")
+
+	p := t.loadPartial(ctx, m.key)
+	if p == nil || !p.sameRepresentation(header, size) {
+		p = &partialContent{size: size}
+	}
+	p.header, p.meta = header, m
+	p.add(start, data)
+
+	if !p.complete() {
+		b, err := p.encode()
+		if err == nil {
+			t.cacheSet(ctx, partialKey(m.key), b)
+		}
+		return
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: size,
+		Body:          ioutil.NopCloser(bytes.NewReader(p.parts[0].data)),
+	}
+	b, err := dumpEntry(m, resp, true)
+	if err == nil {
+		t.storeResponse(ctx, m.key, nil, header, b)
+		t.cacheDelete(ctx, partialKey(m.key))
+	}
+}
+
+// storePartialResponse arranges for the body of resp, a response to the Range request
+// req, to be stored as partial content as it is read. Only single part responses of
+// known size, carrying a strong entity tag and no Vary header, are stored. The data
+// read is stored even if the body is closed early, so that interrupted downloads can
+// be resumed.
+func (t *Transport) storePartialResponse(key string, req *http.Request, resp *http.Response, requestTime, responseTime time.Time) {
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("vary") != "" ||
+		t.tooLarge(resp) || t.isStreaming(resp) || !t.canStore(req, resp) {
+		return
+	}
+	start, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || (t.MaxCacheableBodySize > 0 && size > t.MaxCacheableBodySize) {
+		return
+	}
+	header := t.storedHeader(resp.Header)
+	setMissingDate(header, responseTime)
+	m := newEntryMeta(key, req, header, requestTime, responseTime)
+	store := func(r io.Reader) {
+		data, err := ioutil.ReadAll(r)
+		if err == nil {
+			t.storePartial(req.Context(), m, header, size, start, data)
+		}
+	}
+	resp.Body = &cachingReadCloser{R: resp.Body, Limit: t.MaxCacheableBodySize, OnEOF: store, OnClose: store}
+}
+
+// partialRangeResponse returns the response to the Range request req built from the
+// parts of a representation stored after earlier partial responses, or nil if they
+// don't hold all of the requested ranges.
+func (t *Transport) partialRangeResponse(req *http.Request) *http.Response {
+	p := t.loadPartial(req.Context(), t.key(req))
+	if p == nil {
+		return nil
+	}
+	stored := &http.Response{StatusCode: http.StatusPartialContent, Header: p.header}
+	if t.getFreshness(stored, p.meta, req) != fresh {
+		return nil
+	}
+	return t.rangeResponse(p, req)
+}
+
+// multiReadCloser reads from Reader, and closes Closer.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// fetchResuming sends the GET request req upstream. If the beginning of the response is
+// already known from an interrupted download, only the rest of it is requested, using
+// If-Range so that the whole response is sent if it has changed since.
+func (t *Transport) fetchResuming(transport http.RoundTripper, req *http.Request, key string) (*http.Response, error) {
+	p := t.loadPartial(req.Context(), key)
+	if p == nil || p.parts[0].start != 0 || !strings.HasPrefix(p.header.Get("etag"), `"`) {
+		return transport.RoundTrip(req)
+	}
+	prefix := p.parts[0].data
+	req2 := cloneRequest(req)
+	req2.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(prefix)))
+	req2.Header.Set("If-Range", p.header.Get("etag"))
+	resp, err := transport.RoundTrip(req2)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		// The whole response was sent, as the representation changed
+		return resp, err
+	}
+	first, last, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || first != int64(len(prefix)) || last != size-1 || !p.sameRepresentation(resp.Header, size) {
+		resp.Body.Close()
+		return transport.RoundTrip(req)
+	}
+
+	resp.StatusCode = http.StatusOK
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Del("Content-Range")
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	resp.ContentLength = size
+	resp.Request = req
+	resp.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(prefix), resp.Body), resp.Body}
+	return resp, nil
+}
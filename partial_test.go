@@ -0,0 +1,168 @@
+package httpcache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPartialContentAdd(t *testing.T) {
+	p := &partialContent{size: 10}
+	p.add(0, []byte("01"))
+	p.add(4, []byte("45"))
+	if len(p.parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(p.parts))
+	}
+	p.add(2, []byte("23"))
+	if len(p.parts) != 1 || string(p.parts[0].data) != "012345" {
+		t.Fatalf("contiguous parts weren't merged: %v", p.parts)
+	}
+	p.add(1, []byte("xx"))
+	if len(p.parts) != 1 || string(p.parts[0].data) != "0xx345" {
+		t.Fatalf("overlapping parts weren't merged: %v", p.parts)
+	}
+	if p.complete() {
+		t.Fatal("partial content is complete")
+	}
+	p.add(6, []byte("6789"))
+	if !p.complete() {
+		t.Fatal("partial content isn't complete")
+	}
+}
+
+func TestPartialContentEncoding(t *testing.T) {
+	responseTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	p := &partialContent{header: http.Header{}, size: 10}
+	p.header.Set("Etag", `"abc"`)
+	p.header.Set("Content-Type", "text/plain")
+	p.meta = newEntryMeta("http://example.com/", nil, p.header, responseTime, responseTime)
+	p.add(0, []byte("01"))
+	p.add(5, []byte("567"))
+	b, err := p.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(entryPrefix+strconv.Itoa(entryVersion)+"\n")) {
+		t.Fatalf("partial content isn't stored as an entry: %q", b)
+	}
+	p2, err := decodePartialContent(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.size != 10 || len(p2.parts) != 2 {
+		t.Fatalf("got size %d and %d parts, want 10 and 2", p2.size, len(p2.parts))
+	}
+	if p2.parts[1].start != 5 || string(p2.parts[1].data) != "567" {
+		t.Fatalf("got part %d %q, want 5 %q", p2.parts[1].start, p2.parts[1].data, "567")
+	}
+	if p2.header.Get("Etag") != `"abc"` || p2.header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("headers weren't kept: %v", p2.header)
+	}
+	if !reflect.DeepEqual(p2.meta, p.meta) {
+		t.Fatalf("got metadata %+v, want %+v", p2.meta, p.meta)
+	}
+
+	// Partial content is only read from entries
+	if _, err := decodePartialContent(b[len(p.meta.encode()):]); err == nil {
+		t.Fatal("partial content without metadata was decoded")
+	}
+}
+
+func TestCombinePartialResponses(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	if _, body := fetch(t, tp, "", "Range", "bytes=0-4"); body != "01234" {
+		t.Fatalf("got body %q, want %q", body, "01234")
+	}
+	resp, body := fetch(t, tp, "", "Range", "bytes=1-3")
+	if resp.StatusCode != http.StatusPartialContent || body != "123" {
+		t.Fatalf("got %d %q, want 206 %q", resp.StatusCode, body, "123")
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if _, body := fetch(t, tp, "", "Range", "bytes=5-"); body != "56789" {
+		t.Fatalf("got body %q, want %q", body, "56789")
+	}
+
+	// The two parts make up the whole representation
+	resp, body = fetch(t, tp, "")
+	if resp.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "0123456789")
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if got := upstream.count(); got != 2 {
+		t.Fatalf("got %d upstream requests, want 2", got)
+	}
+}
+
+func TestPartialResponsesOfLargeRepresentations(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	tp.MaxCacheableBodySize = 9
+
+	// Each part is small enough, but not the whole representation
+	for _, rangeHeader := range []string{"bytes=0-4", "bytes=5-"} {
+		fetch(t, tp, "", "Range", rangeHeader)
+	}
+	if _, ok := tp.Cache.Get(partialKey(fakeURL)); ok {
+		t.Fatal("parts of a representation larger than MaxCacheableBodySize were stored")
+	}
+	if _, ok := tp.Cache.Get(fakeURL); ok {
+		t.Fatal("representation larger than MaxCacheableBodySize was stored")
+	}
+}
+
+func TestResumeInterruptedDownload(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	req, err := http.NewRequest("GET", fakeURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err = tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+			t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "0123456789")
+		}
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if got := upstream.count(); got != 2 || upstream.request(1).Header.Get("Range") != "bytes=4-" {
+		t.Fatalf("got %d upstream requests, want the download to resume at byte 4", got)
+	}
+}
@@ -0,0 +1,148 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Policy overrides the caching rules for selected responses, typically those of servers
+// that send no cache headers, or unsuitable ones.
+type Policy interface {
+	// Rule returns the rule applying to resp, the response to req, or nil if the standard
+	// rules apply. It is also called with a nil resp before req is handled, to find out
+	// whether it bypasses the cache.
+	Rule(req *http.Request, resp *http.Response) *Rule
+}
+
+// Rule describes the responses it applies to, and how their caching is changed. The
+// conditions left empty match all responses.
+type Rule struct {
+	// Host is the host of the request URL, with or without its port. A leading "*." matches
+	// any subdomain.
+	Host string
+	// PathPrefix is a prefix of the request URL path.
+	PathPrefix string
+	// Methods lists the request methods matched.
+	Methods []string
+	// StatusCodes lists the response status codes matched. Rules with status codes never
+	// match before the response is known, and so can't bypass the cache.
+	StatusCodes []int
+
+	// DefaultTTL, if not zero, is the freshness lifetime of the responses without an explicit
+	// expiration time, in place of a heuristic one. Only the responses whose status code is
+	// cacheable by default are stored, unless other status codes are listed in StatusCodes,
+	// CacheableStatusCodes or Transport.CacheableStatusCodes, so that errors aren't served
+	// from the cache for the whole TTL.
+	DefaultTTL time.Duration
+	// MinTTL and MaxTTL, if not zero, bound the freshness lifetime of the responses.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// If true, no-store directives in the responses are ignored.
+	IgnoreNoStore bool
+	// If true, no-cache directives in the responses are ignored, so that they can be served
+	// without revalidation while fresh.
+	IgnoreNoCache bool
+	// StaleIfError, if not zero, allows the responses to be served stale when the server
+	// can't be reached or fails, up to this age, as with a stale-if-error directive.
+	StaleIfError time.Duration
+	// CacheableStatusCodes, if not empty, limits the status codes of the responses that are
+	// stored, in addition to Transport.CacheableStatusCodes.
+	CacheableStatusCodes []int
+	// If true, the requests are forwarded without looking for a cached response, and their
+	// responses are not stored.
+	Bypass bool
+}
+
+// Matches returns true if the rule applies to resp, the response to req. If resp is nil,
+// it returns true if the rule applies to all the responses to req.
+func (r *Rule) Matches(req *http.Request, resp *http.Response) bool {
+	if r.Host != "" && !matchHost(r.Host, req.URL) {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		matched := false
+		for _, method := range r.Methods {
+			if strings.EqualFold(method, req.Method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.StatusCodes) > 0 {
+		if resp == nil {
+			return false
+		}
+		matched := false
+		for _, code := range r.StatusCodes {
+			if code == resp.StatusCode {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost returns true if the host of u matches pattern.
+func matchHost(pattern string, u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	hostname := host
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:i]
+	}
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(hostname, pattern[1:]) || strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host || pattern == hostname
+}
+
+// Rules is a Policy applying the first of its rules that matches a response.
+type Rules []Rule
+
+// Rule returns the first rule in rules matching resp, the response to req.
+func (rules Rules) Rule(req *http.Request, resp *http.Response) *Rule {
+	for i := range rules {
+		if rules[i].Matches(req, resp) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// rule returns the rule of the Policy of t applying to resp, the response to req, if any.
+func (t *Transport) rule(req *http.Request, resp *http.Response) *Rule {
+	if t.Policy == nil || req == nil || req.URL == nil {
+		return nil
+	}
+	return t.Policy.Rule(req, resp)
+}
+
+// lifetime returns the freshness lifetime of resp, adjusted by rule if it isn't nil.
+func (t *Transport) lifetime(rule *Rule, resp *http.Response, respCacheControl CacheControl, date time.Time) time.Duration {
+	lifetime := t.freshnessLifetime(resp, respCacheControl, date)
+	if rule == nil {
+		return lifetime
+	}
+	if rule.DefaultTTL != 0 && !t.hasExplicitExpiration(resp, respCacheControl) {
+		lifetime = rule.DefaultTTL
+	}
+	if rule.MinTTL != 0 && lifetime < rule.MinTTL {
+		lifetime = rule.MinTTL
+	}
+	if rule.MaxTTL != 0 && lifetime > rule.MaxTTL {
+		lifetime = rule.MaxTTL
+	}
+	return lifetime
+}
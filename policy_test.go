@@ -0,0 +1,167 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule   Rule
+		method string
+		url    string
+		status int
+		want   bool
+	}{
+		{Rule{}, "GET", "http://example.com/", 200, true},
+		{Rule{Host: "example.com"}, "GET", "http://EXAMPLE.com:8080/", 200, true},
+		{Rule{Host: "example.com:8080"}, "GET", "http://example.com:8080/", 200, true},
+		{Rule{Host: "example.com:8080"}, "GET", "http://example.com/", 200, false},
+		{Rule{Host: "example.com"}, "GET", "http://api.example.com/", 200, false},
+		{Rule{Host: "*.example.com"}, "GET", "http://api.example.com/", 200, true},
+		{Rule{Host: "*.example.com"}, "GET", "http://example.com/", 200, false},
+		{Rule{PathPrefix: "/api/"}, "GET", "http://example.com/api/items", 200, true},
+		{Rule{PathPrefix: "/api/"}, "GET", "http://example.com/static/app.js", 200, false},
+		{Rule{Methods: []string{"GET"}}, "HEAD", "http://example.com/", 200, false},
+		{Rule{Methods: []string{"GET", "HEAD"}}, "HEAD", "http://example.com/", 200, true},
+		{Rule{StatusCodes: []int{200, 404}}, "GET", "http://example.com/", 404, true},
+		{Rule{StatusCodes: []int{200, 404}}, "GET", "http://example.com/", 500, false},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		resp := &http.Response{StatusCode: test.status}
+		if got := test.rule.Matches(req, resp); got != test.want {
+			t.Errorf("%d. %+v, %s %s %d: got %v, want %v", i, test.rule, test.method, test.url, test.status, got, test.want)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	resetTest()
+	cacheControl := map[string]string{
+		"/none":    "",
+		"/short":   "max-age=10",
+		"/long":    "max-age=86400",
+		"/nostore": "no-store",
+		"/nocache": "no-cache, max-age=3600",
+	}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		if cc := cacheControl[req.URL.Path]; cc != "" {
+			header.Set("Cache-Control", cc)
+		}
+		status := http.StatusOK
+		switch req.URL.Host {
+		case "errors.example.com", "outage.example.com":
+			status = http.StatusInternalServerError
+		case "missing.example.com":
+			status = http.StatusNotFound
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	}}
+	tp.Policy = Rules{
+		{Host: "errors.example.com", StatusCodes: []int{500}, DefaultTTL: time.Minute},
+		{Host: "missing.example.com", CacheableStatusCodes: []int{200}, DefaultTTL: time.Minute},
+		{Host: "admin.example.com", Bypass: true},
+		{Host: "outage.example.com", DefaultTTL: time.Minute},
+		{Host: "api.example.com", DefaultTTL: time.Minute, MinTTL: 30 * time.Second, MaxTTL: time.Hour, IgnoreNoStore: true, IgnoreNoCache: true},
+	}
+	get := func(u string) *http.Response {
+		req, _ := http.NewRequest("GET", u, nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	// cached reports whether the response to a GET request for u is served from the cache
+	// the given time after it was stored.
+	cached := func(u string, elapsed time.Duration) bool {
+		clock = &realClock{}
+		get(u)
+		clock = &fakeClock{elapsed: elapsed}
+		return get(u).Header.Get(XFromCache) == "1"
+	}
+
+	tests := []struct {
+		url     string
+		elapsed time.Duration
+		want    bool
+	}{
+		{"http://api.example.com/none", 50 * time.Second, true},
+		{"http://api.example.com/none", 2 * time.Minute, false},
+		{"http://other.example.com/none", 50 * time.Second, false},
+		{"http://api.example.com/short", 20 * time.Second, true},
+		{"http://api.example.com/short", 40 * time.Second, false},
+		{"http://api.example.com/long", 2 * time.Hour, false},
+		{"http://api.example.com/nostore", 10 * time.Second, true},
+		{"http://other.example.com/nostore", 0, false},
+		{"http://api.example.com/nocache", 10 * time.Second, true},
+		{"http://other.example.com/nocache", 0, false},
+		{"http://errors.example.com/none", 10 * time.Second, true},
+		{"http://missing.example.com/none", 0, false},
+		{"http://outage.example.com/none", 0, false},
+		{"http://admin.example.com/long", 0, false},
+	}
+	for _, test := range tests {
+		tp.Cache = NewMemoryCache()
+		if got := cached(test.url, test.elapsed); got != test.want {
+			t.Errorf("%s after %v: got cached %v, want %v", test.url, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestPolicyStaleIfError(t *testing.T) {
+	resetTest()
+	fail := false
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=10")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	}}
+	tp.Policy = Rules{{StaleIfError: time.Hour}}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	fail = true
+	clock = &fakeClock{elapsed: 30 * time.Minute}
+	resp, err = tp.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("got error %v, want the stale response", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("stale response wasn't served")
+	}
+	clock = &fakeClock{elapsed: 2 * time.Hour}
+	if _, err = tp.RoundTrip(req); err == nil {
+		t.Fatal("response was served stale beyond the stale-if-error window")
+	}
+}
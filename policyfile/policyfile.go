@@ -0,0 +1,335 @@
+// Package policyfile configures the caching policy of an httpcache.Transport from a JSON or
+// YAML file, which can be reloaded while in use.
+//
+// The file lists rules, the first one matching a response applying to it:
+//
+//	rules:
+//	  - host: api.example.com
+//	    path_prefix: /v1/
+//	    default_ttl: 5m
+//	    max_ttl: 1h
+//	    stale_if_error: 1d
+//	    cacheable_status_codes: [200, 404]
+//	    key:
+//	      sort_query: true
+//	      drop_query_params: [sid]
+//	  - host: "*.example.com"
+//	    path_prefix: /admin/
+//	    bypass: true
+//
+// Durations are written as accepted by time.ParseDuration, with the "d" unit for days added.
+package policyfile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	"gopkg.in/yaml.v2"
+)
+
+// file is the content of a policy file.
+type file struct {
+	Rules []rule `json:"rules" yaml:"rules"`
+}
+
+// rule is a rule as written in a policy file. See httpcache.Rule for the meaning of its
+// fields.
+type rule struct {
+	Host                 string   `json:"host" yaml:"host"`
+	PathPrefix           string   `json:"path_prefix" yaml:"path_prefix"`
+	Methods              []string `json:"methods" yaml:"methods"`
+	StatusCodes          []int    `json:"status_codes" yaml:"status_codes"`
+	DefaultTTL           string   `json:"default_ttl" yaml:"default_ttl"`
+	MinTTL               string   `json:"min_ttl" yaml:"min_ttl"`
+	MaxTTL               string   `json:"max_ttl" yaml:"max_ttl"`
+	StaleIfError         string   `json:"stale_if_error" yaml:"stale_if_error"`
+	IgnoreNoStore        bool     `json:"ignore_no_store" yaml:"ignore_no_store"`
+	IgnoreNoCache        bool     `json:"ignore_no_cache" yaml:"ignore_no_cache"`
+	CacheableStatusCodes []int    `json:"cacheable_status_codes" yaml:"cacheable_status_codes"`
+	Bypass               bool     `json:"bypass" yaml:"bypass"`
+	Key                  *key     `json:"key" yaml:"key"`
+}
+
+// key lists the normalizations applied to the URLs of the requests matched by a rule to
+// compute their cache keys.
+type key struct {
+	SortQuery       bool     `json:"sort_query" yaml:"sort_query"`
+	DropQueryParams []string `json:"drop_query_params" yaml:"drop_query_params"`
+	LowercaseHost   bool     `json:"lowercase_host" yaml:"lowercase_host"`
+	StripFragment   bool     `json:"strip_fragment" yaml:"strip_fragment"`
+}
+
+// policy is a parsed and validated policy file.
+type policy struct {
+	rules httpcache.Rules
+	keys  []func(req *http.Request) string // by rule, nil for the default key
+}
+
+// Policy is an httpcache.Policy read from a file.
+type Policy struct {
+	path string
+
+	mu      sync.RWMutex
+	policy  *policy
+	modTime time.Time
+	size    int64
+}
+
+// Load reads the policy file at path, which is in YAML if its extension is .yaml or .yml,
+// and in JSON otherwise.
+func Load(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Parse parses and validates a policy file, in YAML if isYAML is true and in JSON
+// otherwise.
+func Parse(data []byte, isYAML bool) (*Policy, error) {
+	parsed, err := parse(data, isYAML)
+	if err != nil {
+		return nil, err
+	}
+	return &Policy{policy: parsed}, nil
+}
+
+// Reload reads the policy file again. If it is invalid, the policy in use is kept and
+// the error is returned.
+func (p *Policy) Reload() error {
+	if p.path == "" {
+		return nil
+	}
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(p.path))
+	parsed, err := parse(data, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return fmt.Errorf("%s: %v", p.path, err)
+	}
+	p.mu.Lock()
+	p.policy, p.modTime, p.size = parsed, info.ModTime(), info.Size()
+	p.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the policy file whenever it changes, checking it at the given interval,
+// until ctx is done. Errors are passed to onError, if it isn't nil, and the policy in use
+// is kept until the file is fixed.
+func (p *Policy) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	if p.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(p.path)
+		if err == nil {
+			p.mu.RLock()
+			changed := !info.ModTime().Equal(p.modTime) || info.Size() != p.size
+			p.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			err = p.Reload()
+		}
+		if err != nil {
+			// Don't report the same error until the file changes again
+			if info != nil {
+				p.mu.Lock()
+				p.modTime, p.size = info.ModTime(), info.Size()
+				p.mu.Unlock()
+			}
+			if onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Apply makes t use the policy, along with the cache keys it defines.
+func (p *Policy) Apply(t *httpcache.Transport) {
+	t.Policy = p
+	t.KeyFunc = p.Key
+}
+
+func (p *Policy) current() *policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.policy
+}
+
+// Rule returns the first rule of the policy matching resp, the response to req.
+func (p *Policy) Rule(req *http.Request, resp *http.Response) *httpcache.Rule {
+	return p.current().rules.Rule(req, resp)
+}
+
+// Key returns the cache key for req, normalized as set by the first rule matching all
+// the responses to req that has key settings.
+func (p *Policy) Key(req *http.Request) string {
+	policy := p.current()
+	for i := range policy.rules {
+		if policy.keys[i] != nil && policy.rules[i].Matches(req, nil) {
+			return policy.keys[i](req)
+		}
+	}
+	return httpcache.NormalizedKey()(req)
+}
+
+// parse parses and validates the content of a policy file.
+func parse(data []byte, isYAML bool) (*policy, error) {
+	var f file
+	if isYAML {
+		if err := yaml.UnmarshalStrict(data, &f); err != nil {
+			return nil, err
+		}
+	} else {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&f); err != nil {
+			return nil, err
+		}
+	}
+	p := &policy{}
+	for i, r := range f.Rules {
+		compiled, keyFunc, err := r.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %v", i, err)
+		}
+		p.rules = append(p.rules, *compiled)
+		p.keys = append(p.keys, keyFunc)
+	}
+	return p, nil
+}
+
+// compile validates r, and returns the httpcache.Rule it describes along with the
+// function computing the cache keys of the requests it matches, if it has key settings.
+func (r *rule) compile() (*httpcache.Rule, func(*http.Request) string, error) {
+	compiled := &httpcache.Rule{
+		Host:                 r.Host,
+		PathPrefix:           r.PathPrefix,
+		Methods:              r.Methods,
+		StatusCodes:          r.StatusCodes,
+		IgnoreNoStore:        r.IgnoreNoStore,
+		IgnoreNoCache:        r.IgnoreNoCache,
+		CacheableStatusCodes: r.CacheableStatusCodes,
+		Bypass:               r.Bypass,
+	}
+	if strings.ContainsAny(r.Host, "/?#") || strings.Contains(strings.TrimPrefix(r.Host, "*."), "*") {
+		return nil, nil, fmt.Errorf("host: invalid host %q", r.Host)
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return nil, nil, fmt.Errorf(`path_prefix: %q doesn't start with "/"`, r.PathPrefix)
+	}
+	for _, method := range r.Methods {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return nil, nil, fmt.Errorf("methods: invalid method %q", method)
+		}
+	}
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			return nil, nil, fmt.Errorf("status_codes: invalid status code %d", code)
+		}
+	}
+	for _, code := range r.CacheableStatusCodes {
+		if code < 100 || code > 599 {
+			return nil, nil, fmt.Errorf("cacheable_status_codes: invalid status code %d", code)
+		}
+	}
+	durations := []struct {
+		field string
+		value string
+		d     *time.Duration
+	}{
+		{"default_ttl", r.DefaultTTL, &compiled.DefaultTTL},
+		{"min_ttl", r.MinTTL, &compiled.MinTTL},
+		{"max_ttl", r.MaxTTL, &compiled.MaxTTL},
+		{"stale_if_error", r.StaleIfError, &compiled.StaleIfError},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.d, err = parseDuration(d.value); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", d.field, err)
+		}
+	}
+	if compiled.MinTTL != 0 && compiled.MaxTTL != 0 && compiled.MinTTL > compiled.MaxTTL {
+		return nil, nil, fmt.Errorf("min_ttl %v is greater than max_ttl %v", compiled.MinTTL, compiled.MaxTTL)
+	}
+	if r.Bypass {
+		if len(r.StatusCodes) > 0 {
+			return nil, nil, fmt.Errorf("bypass: can't be used with status_codes, as requests are bypassed before their response is known")
+		}
+		if r.DefaultTTL != "" || r.MinTTL != "" || r.MaxTTL != "" || r.StaleIfError != "" || r.IgnoreNoStore ||
+			r.IgnoreNoCache || len(r.CacheableStatusCodes) > 0 || r.Key != nil {
+			return nil, nil, fmt.Errorf("bypass: can't be used with settings for cached responses")
+		}
+	}
+	if r.Key == nil {
+		return compiled, nil, nil
+	}
+	if len(r.StatusCodes) > 0 {
+		return nil, nil, fmt.Errorf("key: can't be used with status_codes, as keys are needed before the response is known")
+	}
+	var normalizations []func(*url.URL)
+	if r.Key.SortQuery {
+		normalizations = append(normalizations, httpcache.SortQuery)
+	}
+	if len(r.Key.DropQueryParams) > 0 {
+		normalizations = append(normalizations, httpcache.DropQueryParams(r.Key.DropQueryParams...))
+	}
+	if r.Key.LowercaseHost {
+		normalizations = append(normalizations, httpcache.LowercaseHost)
+	}
+	if r.Key.StripFragment {
+		normalizations = append(normalizations, httpcache.StripFragment)
+	}
+	return compiled, httpcache.NormalizedKey(normalizations...), nil
+}
+
+// parseDuration parses a non-negative duration as time.ParseDuration does, also accepting
+// whole numbers of days such as "7d".
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int64
+		n, err = strconv.ParseInt(days, 10, 64)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,205 @@
+package policyfile
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+)
+
+const yamlPolicy = `
+rules:
+  - host: api.example.com
+    path_prefix: /v1/
+    default_ttl: 5m
+    max_ttl: 1h
+    stale_if_error: 1d
+    cacheable_status_codes: [200, 404]
+    key:
+      sort_query: true
+      drop_query_params: [sid]
+  - host: "*.example.com"
+    path_prefix: /admin/
+    bypass: true
+`
+
+const jsonPolicy = `{
+  "rules": [
+    {
+      "host": "api.example.com",
+      "path_prefix": "/v1/",
+      "default_ttl": "5m",
+      "max_ttl": "1h",
+      "stale_if_error": "1d",
+      "cacheable_status_codes": [200, 404],
+      "key": {"sort_query": true, "drop_query_params": ["sid"]}
+    },
+    {"host": "*.example.com", "path_prefix": "/admin/", "bypass": true}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		data   string
+		isYAML bool
+	}{
+		{"yaml", yamlPolicy, true},
+		{"json", jsonPolicy, false},
+	} {
+		p, err := Parse([]byte(test.data), test.isYAML)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		req, _ := http.NewRequest("GET", "http://api.example.com/v1/items?sid=1&b=2&a=1", nil)
+		rule := p.Rule(req, &http.Response{StatusCode: 200})
+		if rule == nil {
+			t.Fatalf("%s: no rule for %s", test.name, req.URL)
+		}
+		if rule.DefaultTTL != 5*time.Minute || rule.MaxTTL != time.Hour || rule.StaleIfError != 24*time.Hour {
+			t.Errorf("%s: got rule %+v", test.name, rule)
+		}
+		if got := p.Key(req); got != "http://api.example.com/v1/items?a=1&b=2" {
+			t.Errorf("%s: got key %q", test.name, got)
+		}
+		req, _ = http.NewRequest("GET", "http://www.example.com/admin/users", nil)
+		if rule := p.Rule(req, nil); rule == nil || !rule.Bypass {
+			t.Errorf("%s: got rule %+v for %s, want a bypass rule", test.name, rule, req.URL)
+		}
+		if got := p.Key(req); got != "http://www.example.com/admin/users" {
+			t.Errorf("%s: got default key %q", test.name, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`rules: [{default_ttl: soon}]`, `rules[0]: default_ttl: invalid duration "soon"`},
+		{`rules: [{}, {max_ttl: -1h}]`, `rules[1]: max_ttl: negative duration "-1h"`},
+		{`rules: [{min_ttl: 2h, max_ttl: 1h}]`, `rules[0]: min_ttl 2h0m0s is greater than max_ttl 1h0m0s`},
+		{`rules: [{path_prefix: api}]`, `rules[0]: path_prefix: "api" doesn't start with "/"`},
+		{`rules: [{host: "a.*.com"}]`, `rules[0]: host: invalid host "a.*.com"`},
+		{`rules: [{status_codes: [999]}]`, `rules[0]: status_codes: invalid status code 999`},
+		{`rules: [{bypass: true, status_codes: [200]}]`, `rules[0]: bypass: can't be used with status_codes`},
+		{`rules: [{bypass: true, default_ttl: 1m}]`, `rules[0]: bypass: can't be used with settings for cached responses`},
+		{`rules: [{status_codes: [200], key: {sort_query: true}}]`, `rules[0]: key: can't be used with status_codes`},
+		{`rules: [{default_tll: 1m}]`, `default_tll`},
+	}
+	for _, test := range tests {
+		_, err := Parse([]byte(test.data), true)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.data, err, test.want)
+		}
+	}
+	if _, err := Parse([]byte(`{"rules": [{"default_tll": "1m"}]}`), false); err == nil || !strings.Contains(err.Error(), "default_tll") {
+		t.Errorf("got error %v for an unknown JSON field", err)
+	}
+}
+
+func TestReloadAndWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yml")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ttl := func(p *Policy) time.Duration {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if rule := p.Rule(req, nil); rule != nil {
+			return rule.DefaultTTL
+		}
+		return 0
+	}
+
+	write(`rules: [{default_ttl: 1m}]`)
+	p, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(`rules: [{default_ttl: never}]`)
+	if err := p.Reload(); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+		t.Fatalf("got error %v reloading an invalid file", err)
+	}
+	if got := ttl(p); got != time.Minute {
+		t.Fatalf("got default TTL %v after a failed reload, want 1m", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go p.Watch(ctx, 10*time.Millisecond, func(err error) { errs <- err })
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid file wasn't reported")
+	}
+	write(`rules: [{default_ttl: 2h}]`)
+	deadline := time.Now().Add(5 * time.Second)
+	for ttl(p) != 2*time.Hour {
+		if time.Now().After(deadline) {
+			t.Fatal("changed file wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApply(t *testing.T) {
+	p, err := Parse([]byte(yamlPolicy), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	tp := httpcache.NewMemoryCacheTransport()
+	tp.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=3600")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("some data")),
+		}, nil
+	})
+	p.Apply(tp)
+
+	get := func(u string) *http.Response {
+		req, _ := http.NewRequest("GET", u, nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	get("http://api.example.com/v1/items?sid=1")
+	if resp := get("http://api.example.com/v1/items?sid=2"); resp.Header.Get(httpcache.XFromCache) != "1" {
+		t.Fatalf("response wasn't served from the cache, %d requests", requests)
+	}
+	get("http://www.example.com/admin/")
+	if resp := get("http://www.example.com/admin/"); resp.Header.Get(httpcache.XFromCache) != "" {
+		t.Fatal("bypassed response was served from the cache")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,344 @@
+package httpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var (
+	// errInvalidRange indicates a Range header that can't be parsed, and must be ignored.
+	errInvalidRange = errors.New("invalid range")
+	// errNoOverlap indicates a Range header none of whose ranges overlap the representation.
+	errNoOverlap = errors.New("invalid range: failed to overlap")
+)
+
+// parseRange parses a Range header string as per https://tools.ietf.org/html/rfc9110#section-14.2
+// for a representation of the given size.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the range start relative
+			// to the end of the file.
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errInvalidRange
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errNoOverlap
+		}
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches returns true if the If-Range precondition ifRange holds for a stored
+// response with respHeaders, in which case the Range header of the request applies. Only
+// strong validators match, see https://tools.ietf.org/html/rfc9110#section-13.1.5
+func ifRangeMatches(respHeaders http.Header, ifRange string) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// Weak entity tags never match
+		return !strings.HasPrefix(ifRange, "W/") && respHeaders.Get("etag") == ifRange
+	}
+	ifRangeDate, err := ParseHTTPDate(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := ParseHTTPDate(respHeaders.Get("last-modified"))
+	if err != nil || !lastModified.Equal(ifRangeDate) {
+		return false
+	}
+	// A Last-Modified date is only a strong validator if it is at least one second
+	// before the response's Date.
+	date, err := Date(respHeaders)
+	return err == nil && date.Sub(lastModified) >= time.Second
+}
+
+// cachedRangeResponse returns the response to the Range request req built from a fresh
+// response stored in the cache, either complete or made of earlier partial responses. It
+// returns nil if there is no such response, in which case the request has to be forwarded
+// upstream.
+func (t *Transport) cachedRangeResponse(req *http.Request) *http.Response {
+	cachedResp, m, err := t.cachedResponse(req)
+	if err != nil || cachedResp == nil {
+		return t.partialRangeResponse(req)
+	}
+	if cachedResp.StatusCode != http.StatusOK {
+		cachedResp.Body.Close()
+		return t.partialRangeResponse(req)
+	}
+	if !varyMatches(cachedResp, m, req) || t.getFreshness(cachedResp, m, req) != fresh {
+		cachedResp.Body.Close()
+		return nil
+	}
+	if cachedResp.ContentLength < 0 {
+		// Only earlier versions stored responses without their length
+		cachedResp.Body.Close()
+		return nil
+	}
+	return t.streamRangeResponse(cachedResp, m, req)
+}
+
+// streamRangeResponse returns the response to the Range request req built from the fresh
+// cachedResp of known length, stored with the metadata m, whose body is streamed: the
+// bytes before each range are skipped rather than held in memory. Ranges that are not in
+// increasing order are ignored, and the whole response is then sent.
+func (t *Transport) streamRangeResponse(cachedResp *http.Response, m entryMeta, req *http.Request) *http.Response {
+	size := cachedResp.ContentLength
+	ranges, err := []httpRange(nil), errInvalidRange
+	if ifRangeMatches(cachedResp.Header, req.Header.Get("if-range")) {
+		ranges, err = parseRange(req.Header.Get("range"), size)
+	}
+	var sumRanges int64
+	ordered := true
+	for i, ra := range ranges {
+		sumRanges += ra.length
+		if i > 0 && ra.start < ranges[i-1].start+ranges[i-1].length {
+			ordered = false
+		}
+	}
+
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     cachedResp.Header,
+		Request:    req,
+	}
+	body := cachedResp.Body
+	length := size
+	switch {
+	case err == errNoOverlap:
+		body.Close()
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Del("Content-Type")
+		body, length = ioutil.NopCloser(bytes.NewReader(nil)), 0
+	case err != nil || sumRanges > size || !ordered:
+		resp.StatusCode = http.StatusOK
+	case len(ranges) == 1:
+		ra := ranges[0]
+		if _, err := io.CopyN(ioutil.Discard, body, ra.start); err != nil {
+			body.Close()
+			return nil
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", ra.contentRange(size))
+		body = &multiReadCloser{io.LimitReader(body, ra.length), body}
+		length = ra.length
+	default:
+		contentType := resp.Header.Get("Content-Type")
+		var boundary string
+		length, boundary = byterangesLength(contentType, ranges, size)
+		pr, pw := io.Pipe()
+		go func(body io.ReadCloser) {
+			defer body.Close()
+			mw := multipart.NewWriter(pw)
+			mw.SetBoundary(boundary)
+			pw.CloseWithError(streamByteranges(mw, body, contentType, ranges, size))
+		}(body)
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		body = pr
+	}
+	if t.MarkCachedResponses {
+		resp.Header.Set(XFromCache, "1")
+	}
+	setAge(resp.Header, m)
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.ContentLength = length
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.Body = body
+	return resp
+}
+
+// byterangesPartHeader returns the header of the part holding the range ra of a
+// representation of size bytes in a multipart/byteranges body.
+func byterangesPartHeader(contentType string, ra httpRange, size int64) textproto.MIMEHeader {
+	partHeader := textproto.MIMEHeader{}
+	if contentType != "" {
+		partHeader.Set("Content-Type", contentType)
+	}
+	partHeader.Set("Content-Range", ra.contentRange(size))
+	return partHeader
+}
+
+// byterangesLength returns the length of the multipart/byteranges body holding the given
+// ranges of a representation of size bytes, along with the boundary it is to be written
+// with.
+func byterangesLength(contentType string, ranges []httpRange, size int64) (int64, string) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	for _, ra := range ranges {
+		mw.CreatePart(byterangesPartHeader(contentType, ra, size))
+		w += countingWriter(ra.length)
+	}
+	mw.Close()
+	return int64(w), mw.Boundary()
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// streamByteranges writes to mw the given ranges, in increasing order, of the
+// representation of size bytes read from r.
+func streamByteranges(mw *multipart.Writer, r io.Reader, contentType string, ranges []httpRange, size int64) error {
+	var offset int64
+	for _, ra := range ranges {
+		if _, err := io.CopyN(ioutil.Discard, r, ra.start-offset); err != nil {
+			return err
+		}
+		part, err := mw.CreatePart(byterangesPartHeader(contentType, ra, size))
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(part, r, ra.length); err != nil {
+			return err
+		}
+		offset = ra.start + ra.length
+	}
+	return mw.Close()
+}
+
+// rangeResponse returns the response to the Range request req built from the known parts
+// of the representation p, or nil if some of the requested ranges aren't known. When the
+// Range header is ignored, the whole representation is sent if it is known.
+func (t *Transport) rangeResponse(p *partialContent, req *http.Request) *http.Response {
+	ranges, err := []httpRange(nil), errInvalidRange
+	if ifRangeMatches(p.header, req.Header.Get("if-range")) {
+		ranges, err = parseRange(req.Header.Get("range"), p.size)
+	}
+	var sumRanges int64
+	for _, ra := range ranges {
+		sumRanges += ra.length
+	}
+
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     cloneHeader(p.header),
+		Request:    req,
+	}
+	var body []byte
+	switch {
+	case err == errNoOverlap:
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", p.size))
+		resp.Header.Del("Content-Type")
+	case err != nil || sumRanges > p.size:
+		// The Range header is ignored, either because of If-Range or because it is
+		// invalid, or too costly to serve: the whole response is sent.
+		if !p.complete() {
+			return nil
+		}
+		resp.StatusCode = http.StatusOK
+		body = p.parts[0].data
+	case len(ranges) == 1:
+		ra := ranges[0]
+		data, ok := p.slice(ra.start, ra.length)
+		if !ok {
+			return nil
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", ra.contentRange(p.size))
+		body = data
+	default:
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := writeByteranges(mw, p, ranges); err != nil {
+			return nil
+		}
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		body = buf.Bytes()
+	}
+	if t.MarkCachedResponses {
+		resp.Header.Set(XFromCache, "1")
+	}
+	setAge(resp.Header, p.meta)
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp
+}
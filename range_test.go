@@ -0,0 +1,218 @@
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		size   int64
+		ranges []httpRange
+		err    error
+	}{
+		{"bytes=0-4", 10, []httpRange{{0, 5}}, nil},
+		{"bytes=2-", 10, []httpRange{{2, 8}}, nil},
+		{"bytes=-3", 10, []httpRange{{7, 3}}, nil},
+		{"bytes=-20", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=5-100", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=0-1, 4-5", 10, []httpRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1,20-30", 10, []httpRange{{0, 2}}, nil},
+		{"bytes=20-30", 10, nil, errNoOverlap},
+		{"bytes=-0", 10, nil, errNoOverlap},
+		{"bytes=5-2", 10, nil, errInvalidRange},
+		{"bytes=a-b", 10, nil, errInvalidRange},
+		{"bytes=", 10, nil, errInvalidRange},
+		{"items=0-4", 10, nil, errInvalidRange},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.s, test.size)
+		if err != test.err {
+			t.Errorf("parseRange(%q): got err %v, want %v", test.s, err, test.err)
+		}
+		if !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("parseRange(%q): got %v, want %v", test.s, ranges, test.ranges)
+		}
+	}
+}
+
+func TestRangeFromCache(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	fetch(t, tp, "")
+
+	resp, body := fetch(t, tp, "", "Range", "bytes=2-5")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("response status code isn't 206 Partial Content: %v", resp.StatusCode)
+	}
+	if body != "2345" {
+		t.Fatalf("got body %q, want %q", body, "2345")
+	}
+	if got, want := resp.Header.Get("Content-Range"), "bytes 2-5/10"; got != want {
+		t.Fatalf("got Content-Range %q, want %q", got, want)
+	}
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+
+	resp, body = fetch(t, tp, "", "Range", "bytes=2-5", "If-Range", `"abc"`)
+	if resp.StatusCode != http.StatusPartialContent || body != "2345" {
+		t.Fatalf("got %d %q, want 206 %q", resp.StatusCode, body, "2345")
+	}
+
+	// If-Range doesn't match: the whole response is sent
+	resp, body = fetch(t, tp, "", "Range", "bytes=2-5", "If-Range", `"def"`)
+	if resp.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "0123456789")
+	}
+
+	resp, _ = fetch(t, tp, "", "Range", "bytes=20-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("response status code isn't 416: %v", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Content-Range"), "bytes */10"; got != want {
+		t.Fatalf("got Content-Range %q, want %q", got, want)
+	}
+
+	if upstream.count() != 1 {
+		t.Fatalf("got %d upstream requests, want 1", upstream.count())
+	}
+}
+
+func TestMultipleRangesFromCache(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+	fetch(t, tp, "")
+
+	resp, body := fetch(t, tp, "", "Range", "bytes=0-1,-2")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("response status code isn't 206 Partial Content: %v", resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/byteranges" {
+		t.Fatalf("got media type %q, want multipart/byteranges", mediaType)
+	}
+	mr := multipart.NewReader(bytes.NewBufferString(body), params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/10", "01"},
+		{"bytes 8-9/10", "89"},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := part.Header.Get("Content-Range"); got != w.contentRange {
+			t.Fatalf("got Content-Range %q, want %q", got, w.contentRange)
+		}
+		if got := part.Header.Get("Content-Type"); got != "text/plain" {
+			t.Fatalf("got Content-Type %q, want %q", got, "text/plain")
+		}
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != w.body {
+			t.Fatalf("got part %q, want %q", b, w.body)
+		}
+	}
+	if upstream.count() != 1 {
+		t.Fatalf("got %d upstream requests, want 1", upstream.count())
+	}
+}
+
+func TestRangeMissForwarded(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	fetch(t, tp, "", "Range", "bytes=2-5")
+	if upstream.count() != 1 {
+		t.Fatalf("got %d upstream requests, want 1", upstream.count())
+	}
+
+	// A stale response is not used
+	fetch(t, tp, "")
+	clock = &fakeClock{elapsed: 2 * time.Hour}
+	fetch(t, tp, "", "Range", "bytes=2-5")
+	if upstream.count() != 3 {
+		t.Fatalf("got %d upstream requests, want 3", upstream.count())
+	}
+}
+
+func TestRangesFromCacheOfAnyLength(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		for _, streaming := range []bool{false, true} {
+			testRangesFromCacheOfAnyLength(t, chunked, streaming)
+		}
+	}
+
+	// Ranges out of order are ignored when the body is streamed
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &fakeTransport{body: "0123456789"}
+	fetch(t, tp, "")
+	if resp, body := fetch(t, tp, "", "Range", "bytes=5-6,0-1"); resp.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Fatalf("got %d %q, want 200 with the whole response", resp.StatusCode, body)
+	}
+}
+
+func testRangesFromCacheOfAnyLength(t *testing.T, chunked, streaming bool) {
+	resetTest()
+	upstream := &fakeTransport{body: "0123456789", chunked: chunked}
+	tp := NewMemoryCacheTransport()
+	if streaming {
+		// The bodies of the cached responses are streamed rather than read in full
+		tp = NewTransport(&streamingMemoryCache{MemoryCache: NewMemoryCache()})
+	}
+	tp.Transport = upstream
+	fetch(t, tp, "")
+
+	tests := []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"bytes=7-", http.StatusPartialContent, "789"},
+		{"bytes=-3", http.StatusPartialContent, "789"},
+		{"bytes=0-0", http.StatusPartialContent, "0"},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, test := range tests {
+		resp, body := fetch(t, tp, "", "Range", test.rangeHeader)
+		if resp.StatusCode != test.status || body != test.body {
+			t.Fatalf("chunked %v, streaming %v, %s: got %d %q, want %d %q", chunked, streaming, test.rangeHeader, resp.StatusCode, body, test.status, test.body)
+		}
+		if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+			t.Fatalf("chunked %v, streaming %v, %s: got Content-Length %s, want %s", chunked, streaming, test.rangeHeader, got, want)
+		}
+	}
+
+	resp, body := fetch(t, tp, "", "Range", "bytes=1-2,5-6")
+	if resp.StatusCode != http.StatusPartialContent || !strings.Contains(body, "12") || !strings.Contains(body, "56") {
+		t.Fatalf("chunked %v, streaming %v: got %d %q for two ranges", chunked, streaming, resp.StatusCode, body)
+	}
+	if got, want := resp.Header.Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+		t.Fatalf("chunked %v, streaming %v: got Content-Length %s, want %s", chunked, streaming, got, want)
+	}
+	if upstream.count() != 1 {
+		t.Fatalf("chunked %v, streaming %v: got %d upstream requests, want 1", chunked, streaming, upstream.count())
+	}
+}
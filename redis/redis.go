@@ -2,14 +2,18 @@
 package redis
 
 import (
+	"context"
+	"time"
+
 	"github.com/gomodule/redigo/redis"
 	"github.com/gregjones/httpcache"
 )
 
-// cache is an implementation of httpcache.Cache that caches responses in a
-// redis server.
+// cache is an implementation of httpcache.Cache and httpcache.ContextCache that
+// caches responses in a redis server, through either a single connection or a pool.
 type cache struct {
 	redis.Conn
+	pool *redis.Pool
 }
 
 // cacheKey modifies an httpcache key for use in redis. Specifically, it
@@ -18,26 +22,95 @@ func cacheKey(key string) string {
 	return "rediscache:" + key
 }
 
+// do sends a command to the server and returns the reply. With a single connection,
+// shared by all the requests, ctx is only checked before the command is sent, as a
+// connection timing out can't be used anymore. With a pool, the command is sent on a
+// connection of its own, whose reply is waited for until ctx is done.
+func (c cache) do(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.pool == nil {
+		return c.Do(commandName, args...)
+	}
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// A connection left broken by a timeout is discarded by the pool once closed
+		defer conn.Close()
+		var r result
+		if deadline, ok := ctx.Deadline(); ok {
+			r.reply, r.err = redis.DoWithTimeout(conn, time.Until(deadline), commandName, args...)
+		} else {
+			r.reply, r.err = conn.Do(commandName, args...)
+		}
+		done <- r
+	}()
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // Get returns the response corresponding to key if present.
 func (c cache) Get(key string) (resp []byte, ok bool) {
-	item, err := redis.Bytes(c.Do("GET", cacheKey(key)))
-	if err != nil {
-		return nil, false
+	resp, ok, _ = c.GetContext(context.Background(), key)
+	return resp, ok
+}
+
+// GetContext returns the response corresponding to key if present. Failing to get
+// it is an error, unlike it being missing.
+func (c cache) GetContext(ctx context.Context, key string) (resp []byte, ok bool, err error) {
+	item, err := redis.Bytes(c.do(ctx, "GET", cacheKey(key)))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
 	}
-	return item, true
+	return item, true, nil
 }
 
 // Set saves a response to the cache as key.
 func (c cache) Set(key string, resp []byte) {
-	c.Do("SET", cacheKey(key), resp)
+	c.SetContext(context.Background(), key, resp)
+}
+
+// SetContext saves a response to the cache as key.
+func (c cache) SetContext(ctx context.Context, key string, resp []byte) error {
+	_, err := c.do(ctx, "SET", cacheKey(key), resp)
+	return err
 }
 
 // Delete removes the response with key from the cache.
 func (c cache) Delete(key string) {
-	c.Do("DEL", cacheKey(key))
+	c.DeleteContext(context.Background(), key)
 }
 
-// NewWithClient returns a new Cache with the given redis connection.
+// DeleteContext removes the response with key from the cache.
+func (c cache) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", cacheKey(key))
+	return err
+}
+
+// NewWithClient returns a new Cache with the given redis connection. It is also an
+// httpcache.ContextCache, whose contexts are only checked before each command is sent:
+// use NewWithPool for commands to be cancelled or time out along with them.
 func NewWithClient(client redis.Conn) httpcache.Cache {
-	return cache{client}
+	return cache{Conn: client}
+}
+
+// NewWithPool returns a new Cache using connections from the given pool, one for each
+// command. It is also an httpcache.ContextCache, whose commands are abandoned once their
+// context is done.
+func NewWithPool(pool *redis.Pool) httpcache.Cache {
+	return cache{pool: pool}
 }
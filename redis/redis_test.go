@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/gregjones/httpcache"
 	"github.com/gregjones/httpcache/test"
 )
 
@@ -15,5 +16,15 @@ func TestRedisCache(t *testing.T) {
 	}
 	conn.Do("FLUSHALL")
 
-	test.Cache(t, NewWithClient(conn))
+	cache := NewWithClient(conn)
+	test.Cache(t, cache)
+	test.ContextCache(t, cache.(httpcache.ContextCache))
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return redis.Dial("tcp", "localhost:6379")
+	}}
+	defer pool.Close()
+	cache = NewWithPool(pool)
+	test.Cache(t, cache)
+	test.ContextCache(t, cache.(httpcache.ContextCache))
 }
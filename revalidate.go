@@ -0,0 +1,120 @@
+package httpcache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// revalidationKey is the context key marking requests made to revalidate a cached
+// response in the background.
+type revalidationKey struct{}
+
+// canStaleWhileRevalidate returns true if the stale cachedResp, stored with the metadata
+// m, is still within the stale-while-revalidate window given by the response, so that it
+// can be returned while being revalidated in the background:
+// https://tools.ietf.org/html/rfc5861#section-3
+func (t *Transport) canStaleWhileRevalidate(cachedResp *http.Response, m entryMeta, req *http.Request) bool {
+	if req.Method != "GET" || req.Context().Value(revalidationKey{}) != nil || requestOptions(req).Revalidate {
+		return false
+	}
+	respCacheControl := ParseCacheControl(cachedResp.Header)
+	reqCacheControl := ParseCacheControl(req.Header)
+	window, ok := respCacheControl["stale-while-revalidate"]
+	if !ok || t.mustRevalidate(respCacheControl) {
+		return false
+	}
+	// The client asked for a response of bounded age
+	if _, ok := reqCacheControl["max-age"]; ok {
+		return false
+	}
+	if _, ok := reqCacheControl["min-fresh"]; ok {
+		return false
+	}
+
+	windowDuration, err := time.ParseDuration(window + "s")
+	if err != nil {
+		return false
+	}
+	date, err := Date(cachedResp.Header)
+	if err != nil {
+		return false
+	}
+	currentAge, err := getCurrentAge(cachedResp.Header, m)
+	if err != nil {
+		return false
+	}
+	lifetime := t.lifetime(t.rule(req, cachedResp), cachedResp, respCacheControl, date)
+	return lifetime+windowDuration > currentAge
+}
+
+// revalidateInBackground starts revalidating the response cached under key by sending
+// req again, unless a revalidation of key is already in flight. It returns false if
+// background revalidations are no longer accepted because of Shutdown.
+func (t *Transport) revalidateInBackground(key string, req *http.Request) bool {
+	t.revalidationMu.Lock()
+	defer t.revalidationMu.Unlock()
+	if t.shutdown {
+		return false
+	}
+	if t.revalidating == nil {
+		t.revalidating = map[string]bool{}
+		t.revalidationCtx, t.cancelRevalidations = context.WithCancel(context.Background())
+	}
+	if t.revalidating[key] {
+		return true
+	}
+	t.revalidating[key] = true
+	t.revalidations.Add(1)
+
+	// The revalidation must outlive the caller's request, so it doesn't use its context.
+	ctx := context.WithValue(t.revalidationCtx, revalidationKey{}, true)
+	req = cloneRequest(req).WithContext(ctx)
+	go func() {
+		defer t.revalidations.Done()
+		defer func() {
+			t.revalidationMu.Lock()
+			delete(t.revalidating, key)
+			t.revalidationMu.Unlock()
+		}()
+		resp, err := t.RoundTrip(req)
+		if err != nil {
+			return
+		}
+		// Reading the body to EOF stores the response
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	return true
+}
+
+// Shutdown waits for the background revalidations started because of
+// stale-while-revalidate to complete. If ctx is done first, the revalidations still
+// in flight are cancelled and ctx's error is returned.
+//
+// Once Shutdown has been called, stale responses are always revalidated before being
+// returned.
+func (t *Transport) Shutdown(ctx context.Context) error {
+	t.revalidationMu.Lock()
+	t.shutdown = true
+	t.revalidationMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.revalidations.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.revalidationMu.Lock()
+		if t.cancelRevalidations != nil {
+			t.cancelRevalidations()
+		}
+		t.revalidationMu.Unlock()
+		return ctx.Err()
+	}
+}
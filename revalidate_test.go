@@ -0,0 +1,97 @@
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=100"}}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	fetch(t, tp, "")
+	clock = &fakeClock{elapsed: 10 * time.Second}
+	resp, _ := fetch(t, tp, "")
+	if resp.Header.Get(XFromCache) != "1" {
+		t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+	}
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := upstream.count(), 2; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+}
+
+func TestStaleWhileRevalidateExpiredWindow(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=100"}}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	fetch(t, tp, "")
+	clock = &fakeClock{elapsed: 200 * time.Second}
+	fetch(t, tp, "")
+	// The response was revalidated before being returned
+	if got, want := upstream.count(), 2; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaleWhileRevalidateDeduplicates(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=100"}}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	fetch(t, tp, "")
+	upstream.release = make(chan struct{})
+	clock = &fakeClock{elapsed: 10 * time.Second}
+	for i := 0; i < 5; i++ {
+		resp, _ := fetch(t, tp, "")
+		if resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf(`XFromCache header isn't "1": %v`, resp.Header.Get(XFromCache))
+		}
+	}
+	close(upstream.release)
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := upstream.count(), 2; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+}
+
+func TestShutdownCancelsRevalidations(t *testing.T) {
+	resetTest()
+	upstream := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=100"}}}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = upstream
+
+	fetch(t, tp, "")
+	upstream.release = make(chan struct{})
+	clock = &fakeClock{elapsed: 10 * time.Second}
+	fetch(t, tp, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tp.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got err %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The cancelled revalidation is now finishing, and no new one is started
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(upstream.release)
+	fetch(t, tp, "")
+	if got, want := upstream.count(), 3; got != want {
+		t.Fatalf("got %d upstream requests, want %d", got, want)
+	}
+}
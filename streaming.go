@@ -0,0 +1,64 @@
+package httpcache
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// streamingMediaTypes are the media types of responses whose bodies are streams of events
+// or parts sent as they happen, rather than documents.
+var streamingMediaTypes = map[string]bool{
+	"text/event-stream":         true,
+	"multipart/x-mixed-replace": true,
+}
+
+// IsStreamingResponse reports whether resp is a streaming response, which must be passed
+// through without buffering its body: a server-sent event stream, a multipart stream
+// replacing its parts as it goes, a protocol switch, or a chunked response carrying
+// neither freshness information (max-age, s-maxage, Expires or Last-Modified) nor a
+// validator (ETag), as sent for long polls. Chunked responses are otherwise ordinary ones
+// whose length wasn't known in advance. It is the default value of Transport.IsStreaming.
+func IsStreamingResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && streamingMediaTypes[mediaType] {
+		return true
+	}
+	if !isChunked(resp) {
+		return false
+	}
+	cc := ParseCacheControl(resp.Header)
+	for _, directive := range []string{"max-age", "s-maxage"} {
+		if _, ok := cc[directive]; ok {
+			return false
+		}
+	}
+	return resp.Header.Get("Expires") == "" && resp.Header.Get("Last-Modified") == "" &&
+		resp.Header.Get("Etag") == ""
+}
+
+// isChunked returns true if the body of resp is sent with the chunked transfer coding.
+func isChunked(resp *http.Response) bool {
+	for _, coding := range resp.TransferEncoding {
+		if strings.EqualFold(coding, "chunked") {
+			return true
+		}
+	}
+	for _, coding := range headerAllCommaSepValues(resp.Header, "Transfer-Encoding") {
+		if strings.EqualFold(coding, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreaming reports whether resp is a streaming response, as decided by the IsStreaming
+// function of t.
+func (t *Transport) isStreaming(resp *http.Response) bool {
+	if t.IsStreaming != nil {
+		return t.IsStreaming(resp)
+	}
+	return IsStreamingResponse(resp)
+}
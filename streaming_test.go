@@ -0,0 +1,121 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsStreamingResponse(t *testing.T) {
+	tests := []struct {
+		status           int
+		header           http.Header
+		transferEncoding []string
+		want             bool
+	}{
+		{200, http.Header{}, nil, false},
+		{101, http.Header{"Upgrade": {"websocket"}}, nil, true},
+		{200, http.Header{"Content-Type": {"text/event-stream"}}, nil, true},
+		{200, http.Header{"Content-Type": {"Text/Event-Stream; charset=utf-8"}, "Cache-Control": {"max-age=60"}}, nil, true},
+		{200, http.Header{"Content-Type": {"multipart/x-mixed-replace; boundary=frame"}}, nil, true},
+		{200, http.Header{"Content-Type": {"application/json"}}, []string{"chunked"}, true},
+		{200, http.Header{"Transfer-Encoding": {"gzip, chunked"}}, nil, true},
+		{200, http.Header{"Cache-Control": {"max-age=60"}}, []string{"chunked"}, false},
+		{200, http.Header{"Expires": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, []string{"chunked"}, false},
+		{200, http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, []string{"chunked"}, false},
+		{200, http.Header{"Etag": {`"v1"`}}, []string{"chunked"}, false},
+	}
+	for i, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Header: test.header, TransferEncoding: test.transferEncoding}
+		if got := IsStreamingResponse(resp); got != test.want {
+			t.Errorf("%d. %d %v %v: got %v, want %v", i, test.status, test.header, test.transferEncoding, got, test.want)
+		}
+	}
+}
+
+func TestStreamingResponsesPassThrough(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=3600")
+		header.Set("Content-Type", req.URL.Query().Get("type"))
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			ContentLength: -1,
+			Request:       req,
+			Body:          ioutil.NopCloser(strings.NewReader("data: event\n\n")),
+		}, nil
+	}}
+	get := func(u string) *http.Response {
+		req, _ := http.NewRequest("GET", u, nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	const events = "http://example.com/events?type=text/event-stream"
+	resp := get(events)
+	if _, ok := resp.Body.(*cachingReadCloser); ok {
+		t.Fatal("event stream is buffered")
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp := get(events); resp.Header.Get(XFromCache) != "" {
+		t.Fatal("event stream was served from the cache")
+	}
+
+	const polls = "http://example.com/poll?type=application/json"
+	tp.IsStreaming = func(resp *http.Response) bool {
+		return strings.HasPrefix(resp.Request.URL.Path, "/poll") || IsStreamingResponse(resp)
+	}
+	resp = get(polls)
+	if _, ok := resp.Body.(*cachingReadCloser); ok {
+		t.Fatal("response detected as streaming by IsStreaming is buffered")
+	}
+	resp.Body.Close()
+}
+
+func TestChunkedResponsesWithValidatorsStored(t *testing.T) {
+	resetTest()
+	tp := NewMemoryCacheTransport()
+	revalidations := 0
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Etag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			revalidations++
+			return &http.Response{StatusCode: http.StatusNotModified, Header: header, Body: http.NoBody, Request: req}, nil
+		}
+		return &http.Response{
+			StatusCode:       http.StatusOK,
+			Header:           header,
+			ContentLength:    -1,
+			TransferEncoding: []string{"chunked"},
+			Request:          req,
+			Body:             ioutil.NopCloser(strings.NewReader("dynamic body")),
+		}, nil
+	}}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "dynamic body" {
+			t.Fatalf("got body %q", body)
+		}
+	}
+	if revalidations != 2 {
+		t.Fatalf("got %d revalidations, want 2", revalidations)
+	}
+}
@@ -0,0 +1,149 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// openEntry returns a reader for the value cached in c under key, streamed if c is a
+// StreamingCache, and false if there is none. The errors of c are returned as *CacheError
+// values.
+func openEntry(ctx context.Context, c Cache, key string) (io.ReadCloser, bool, error) {
+	if sc, ok := c.(StreamingCache); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, false, &CacheError{Op: "open", Key: key, Err: err}
+		}
+		if oc, ok := sc.(ContextStreamingCache); ok {
+			r, ok, err := oc.OpenContext(ctx, key)
+			if err != nil {
+				return nil, false, &CacheError{Op: "open", Key: key, Err: err}
+			}
+			return r, ok, nil
+		}
+		r, ok := sc.Open(key)
+		return r, ok, nil
+	}
+	b, ok, err := cacheGet(ctx, c, key)
+	if !ok {
+		return nil, false, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), true, nil
+}
+
+// readResponse reads the response cached in r, buffered by br, for req, from an entry or a
+// legacy one, along with the metadata of the entry. Its body reads the rest of r, which is
+// closed along with it.
+func readResponse(r io.ReadCloser, br *bufio.Reader, req *http.Request) (*http.Response, entryMeta, error) {
+	m, _, err := readEntryMeta(br)
+	if err != nil {
+		r.Close()
+		return nil, m, err
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		r.Close()
+		return nil, m, err
+	}
+	m.migrateVaried(resp.Header)
+	resp.Body = &entryBody{ReadCloser: resp.Body, entry: r}
+	return resp, m, nil
+}
+
+// entryBody is the body of a cached response, which releases the cached value when
+// closed.
+type entryBody struct {
+	io.ReadCloser
+	entry io.Closer
+}
+
+func (b *entryBody) Close() error {
+	b.ReadCloser.Close()
+	return b.entry.Close()
+}
+
+// createEntry starts storing stored, with the metadata m, in sc under entryKey, and returns
+// the writer to which its body is to be written.
+func (t *Transport) createEntry(ctx context.Context, sc StreamingCache, entryKey string, m entryMeta, stored *http.Response) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w, err := sc.Create(entryKey)
+	if err != nil {
+		t.cacheError(&CacheError{Op: "create", Key: entryKey, Err: err})
+		return nil, err
+	}
+	header := *stored
+	if header.ContentLength < 0 {
+		// The body is written as it is read, rather than chunked, and is read back up to the
+		// end of the value
+		header.TransferEncoding = nil
+		header.Close = true
+	}
+	b, err := dumpEntry(m, &header, false)
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	if err != nil {
+		t.cacheError(&CacheError{Op: "create", Key: entryKey, Err: err})
+		t.abortEntry(ctx, entryKey, w)
+		return nil, err
+	}
+	return w, nil
+}
+
+// closeEntry closes w, a writer for a value being stored under key, and returns true if
+// the value was stored.
+func (t *Transport) closeEntry(key string, w io.WriteCloser) bool {
+	if err := w.Close(); err != nil {
+		t.cacheError(&CacheError{Op: "create", Key: key, Err: err})
+		return false
+	}
+	return true
+}
+
+// sizeEntry rewrites the entry stored in sc under entryKey, whose body of the given size
+// was written without a length, with the length recorded in its header, so that the
+// ranges of the response can be served without reading it in full. It returns false if
+// the entry was lost.
+func (t *Transport) sizeEntry(ctx context.Context, sc StreamingCache, entryKey string, size int64) bool {
+	r, ok, err := openEntry(ctx, sc, entryKey)
+	t.cacheError(err)
+	if !ok {
+		return false
+	}
+	resp, m, err := readResponse(r, bufio.NewReader(r), nil)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	resp.ContentLength = size
+	resp.Close = false
+	resp.Header.Del("Connection")
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	w, err := t.createEntry(ctx, sc, entryKey, m, resp)
+	if err != nil {
+		return false
+	}
+	if _, err := io.CopyN(w, resp.Body, size); err != nil {
+		t.abortEntry(ctx, entryKey, w)
+		return false
+	}
+	return t.closeEntry(entryKey, w)
+}
+
+// abortEntry abandons w, a writer for a value being stored under key.
+func (t *Transport) abortEntry(ctx context.Context, key string, w io.WriteCloser) {
+	if a, ok := w.(interface {
+		Abort() error
+	}); ok {
+		a.Abort()
+		return
+	}
+	w.Close()
+	t.cacheDelete(ctx, key)
+}
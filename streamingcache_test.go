@@ -0,0 +1,207 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamingMemoryCache is a StreamingCache keeping track of the values being read and
+// written.
+type streamingMemoryCache struct {
+	*MemoryCache
+	mu      sync.Mutex
+	open    int // readers not closed yet
+	creates int // writers closed
+}
+
+func (c *streamingMemoryCache) Open(key string) (io.ReadCloser, bool) {
+	b, ok := c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	c.open++
+	c.mu.Unlock()
+	return &trackedReader{Reader: bytes.NewReader(b), c: c}, true
+}
+
+func (c *streamingMemoryCache) Create(key string) (io.WriteCloser, error) {
+	return &bufferedWriter{c: c, key: key}, nil
+}
+
+type trackedReader struct {
+	io.Reader
+	c      *streamingMemoryCache
+	closed bool
+}
+
+func (r *trackedReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.c.mu.Lock()
+		r.c.open--
+		r.c.mu.Unlock()
+	}
+	return nil
+}
+
+type bufferedWriter struct {
+	c      *streamingMemoryCache
+	key    string
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *bufferedWriter) Close() error {
+	if w.closed {
+		return errors.New("writer already closed")
+	}
+	w.closed = true
+	w.c.Set(w.key, w.buf.Bytes())
+	w.c.mu.Lock()
+	w.c.creates++
+	w.c.mu.Unlock()
+	return nil
+}
+
+func (w *bufferedWriter) Abort() error {
+	return nil
+}
+
+func TestStreamingCache(t *testing.T) {
+	resetTest()
+	cache := &streamingMemoryCache{MemoryCache: NewMemoryCache()}
+	tp := NewTransport(cache)
+	tp.OnCacheError = func(err error) {
+		t.Errorf("got cache error %v", err)
+	}
+	etag := `"v1"`
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		header.Set("Cache-Control", "max-age=3600")
+		header.Set("Etag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			return &http.Response{StatusCode: http.StatusNotModified, Header: header, Body: http.NoBody}, nil
+		}
+		contentLength := int64(len("some data"))
+		if req.URL.Path == "/chunked" {
+			contentLength = -1
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			ContentLength: contentLength,
+			Body:          ioutil.NopCloser(strings.NewReader("some data")),
+		}, nil
+	}}
+	get := func(u string, header http.Header, read bool) *http.Response {
+		req, _ := http.NewRequest("GET", u, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read {
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || string(body) != "some data" {
+				t.Fatalf("%s: got body %q, %v", u, body, err)
+			}
+			// Reading again after EOF stores nothing more
+			resp.Body.Read(make([]byte, 1))
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, u := range []string{"http://example.com/", "http://example.com/chunked"} {
+		get(u, nil, false)
+		if cache.creates != 0 {
+			t.Fatalf("%s: response closed early was stored", u)
+		}
+		get(u, nil, true)
+		// A response without a length is stored again once its length is known
+		want := 1
+		if strings.HasSuffix(u, "/chunked") {
+			want = 2
+		}
+		if cache.creates != want {
+			t.Fatalf("%s: got %d responses stored, want %d", u, cache.creates, want)
+		}
+		if resp := get(u, nil, true); resp.ContentLength != int64(len("some data")) {
+			t.Fatalf("%s: got Content-Length %d from the cache", u, resp.ContentLength)
+		}
+		if resp := get(u, nil, true); resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf("%s: response wasn't served from the cache", u)
+		}
+		if cache.open != 0 {
+			t.Fatalf("%s: %d cached values left open", u, cache.open)
+		}
+		cache.creates = 0
+	}
+
+	// A revalidated response is stored again from the cached one
+	get("http://example.com/", http.Header{"Cache-Control": {"max-age=0"}}, true)
+	if cache.creates != 1 {
+		t.Fatalf("got %d responses stored after revalidation, want 1", cache.creates)
+	}
+	if resp := get("http://example.com/", nil, true); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("revalidated response wasn't served from the cache")
+	}
+
+	// Cached responses that are replaced are closed
+	etag = `"v2"`
+	get("http://example.com/", http.Header{"Cache-Control": {"max-age=0"}}, true)
+	if cache.open != 0 {
+		t.Fatalf("%d cached values left open", cache.open)
+	}
+}
+
+// brokenStreamingCache is a ContextStreamingCache failing to open its values.
+type brokenStreamingCache struct {
+	*streamingMemoryCache
+}
+
+func (c brokenStreamingCache) OpenContext(ctx context.Context, key string) (io.ReadCloser, bool, error) {
+	return nil, false, errors.New("disk failure")
+}
+
+var _ ContextStreamingCache = brokenStreamingCache{}
+
+func TestStreamingCacheOpenErrors(t *testing.T) {
+	resetTest()
+	tp := NewTransport(brokenStreamingCache{&streamingMemoryCache{MemoryCache: NewMemoryCache()}})
+	var cacheErrors []error
+	tp.OnCacheError = func(err error) {
+		cacheErrors = append(cacheErrors, err)
+	}
+	tp.Transport = &fakeTransport{respond: func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+	}}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(cacheErrors) == 0 {
+		t.Fatal("error opening a cached value wasn't reported")
+	}
+	if cacheErr, ok := cacheErrors[0].(*CacheError); !ok || cacheErr.Op != "open" {
+		t.Fatalf("got error %v, want a CacheError opening the value", cacheErrors[0])
+	}
+}
@@ -2,6 +2,8 @@ package test
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"testing"
 
 	"github.com/gregjones/httpcache"
@@ -33,3 +35,102 @@ func Cache(t *testing.T, cache httpcache.Cache) {
 		t.Fatal("deleted key still present")
 	}
 }
+
+// StreamingCache excercises a httpcache.StreamingCache implementation, in addition to
+// what Cache does.
+func StreamingCache(t *testing.T, cache httpcache.StreamingCache) {
+	Cache(t, cache)
+
+	key := "testStreamKey"
+	if _, ok := cache.Open(key); ok {
+		t.Fatal("opened key before adding it")
+	}
+
+	old := []byte("old bytes")
+	cache.Set(key, old)
+	val := []byte("some bytes")
+	w, err := cache.Create(key)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w.Write(val[:4])
+	w.Write(val[4:])
+	if retVal, _ := cache.Get(key); !bytes.Equal(retVal, old) {
+		t.Fatal("value was replaced before the writer was closed")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, ok := cache.Open(key)
+	if !ok {
+		t.Fatal("could not open an element we just created")
+	}
+	retVal, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(retVal, val) {
+		t.Fatalf("read %q, %v; want %q", retVal, err, val)
+	}
+	if retVal, _ := cache.Get(key); !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we wrote")
+	}
+
+	if w, err = cache.Create(key); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w.Write([]byte("discarded"))
+	if a, ok := w.(interface {
+		Abort() error
+	}); ok {
+		if err := a.Abort(); err != nil {
+			t.Fatalf("Abort: %v", err)
+		}
+		if retVal, _ := cache.Get(key); !bytes.Equal(retVal, val) {
+			t.Fatal("aborted writer replaced the value")
+		}
+	} else {
+		w.Close()
+	}
+
+	cache.Delete(key)
+	if _, ok := cache.Open(key); ok {
+		t.Fatal("deleted key still present")
+	}
+}
+
+// ContextCache excercises a httpcache.ContextCache implementation.
+func ContextCache(t *testing.T, cache httpcache.ContextCache) {
+	ctx := context.Background()
+	key := "testContextKey"
+	if _, ok, err := cache.GetContext(ctx, key); ok || err != nil {
+		t.Fatalf("got %v, %v for a missing key; want false, nil", ok, err)
+	}
+
+	val := []byte("some bytes")
+	if err := cache.SetContext(ctx, key, val); err != nil {
+		t.Fatalf("SetContext: %v", err)
+	}
+	retVal, ok, err := cache.GetContext(ctx, key)
+	if !ok || err != nil {
+		t.Fatalf("got %v, %v for an element we just added", ok, err)
+	}
+	if !bytes.Equal(retVal, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := cache.GetContext(cancelled, key); err == nil {
+		t.Fatal("got no error with a cancelled context")
+	}
+
+	if err := cache.DeleteContext(ctx, key); err != nil {
+		t.Fatalf("DeleteContext: %v", err)
+	}
+	if _, ok, err := cache.GetContext(ctx, key); ok || err != nil {
+		t.Fatalf("got %v, %v for a deleted key; want false, nil", ok, err)
+	}
+	if err := cache.DeleteContext(ctx, key); err != nil {
+		t.Fatalf("DeleteContext of a missing key: %v", err)
+	}
+}
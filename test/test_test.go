@@ -10,3 +10,7 @@ import (
 func TestMemoryCache(t *testing.T) {
 	test.Cache(t, httpcache.NewMemoryCache())
 }
+
+func TestContextCacheAdapter(t *testing.T) {
+	test.ContextCache(t, httpcache.AsContextCache(httpcache.NewMemoryCache()))
+}
@@ -0,0 +1,291 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// variantIndexPrefix starts the variant index of responses that vary, stored under its
+// own key so that it can be read without reading a response. Each following line
+// describes one stored variant: its secondary key, followed by its entity tag if it has
+// one.
+const variantIndexPrefix = "httpcache variants\n"
+
+// maxVariants is the number of variants kept for a cache key, beyond which the least
+// recently stored ones are discarded.
+const maxVariants = 32
+
+// variant describes a stored response among those that vary for a cache key.
+type variant struct {
+	key  string
+	etag string
+}
+
+// variantIndex lists the stored variants for a cache key, least recently stored first.
+type variantIndex []variant
+
+// variantKey returns the key under which the variant with the given secondary key is
+// stored.
+func variantKey(key, secondary string) string {
+	return key + " variant " + secondary
+}
+
+// variantIndexKey returns the key under which the variant index of the responses with
+// cache key is stored.
+func variantIndexKey(key string) string {
+	return key + " variants"
+}
+
+// secondaryKey returns the secondary key of the variant selected by req among responses
+// that vary on the given request header fields. It holds the normalized values of those
+// fields in req, and so also records which fields they are.
+func secondaryKey(fields []string, req *http.Request) string {
+	v := url.Values{}
+	for _, field := range fields {
+		field = http.CanonicalHeaderKey(field)
+		if field != "" {
+			v.Set(field, strings.Join(headerAllCommaSepValues(req.Header, field), ","))
+		}
+	}
+	return v.Encode()
+}
+
+// decodeVariantIndex returns the variant index in b, and false if b doesn't hold one.
+func decodeVariantIndex(b []byte) (variantIndex, bool) {
+	if !bytes.HasPrefix(b, []byte(variantIndexPrefix)) {
+		return nil, false
+	}
+	var index variantIndex
+	for _, line := range strings.Split(string(b[len(variantIndexPrefix):]), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		v := variant{key: fields[0]}
+		if len(fields) == 2 {
+			v.etag = fields[1]
+		}
+		index = append(index, v)
+	}
+	return index, true
+}
+
+func (index variantIndex) encode() []byte {
+	var b bytes.Buffer
+	b.WriteString(variantIndexPrefix)
+	for _, v := range index {
+		b.WriteString(v.key)
+		if v.etag != "" {
+			b.WriteString(" " + v.etag)
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// match returns the secondary key of the variant selected by req.
+func (index variantIndex) match(req *http.Request) (string, bool) {
+	for i := len(index) - 1; i >= 0; i-- {
+		values, err := url.ParseQuery(index[i].key)
+		if err != nil {
+			continue
+		}
+		fields := make([]string, 0, len(values))
+		for field := range values {
+			fields = append(fields, field)
+		}
+		if secondaryKey(fields, req) == index[i].key {
+			return index[i].key, true
+		}
+	}
+	return "", false
+}
+
+// remove returns index without the variant with the given secondary key.
+func (index variantIndex) remove(secondary string) variantIndex {
+	kept := make(variantIndex, 0, len(index))
+	for _, v := range index {
+		if v.key != secondary {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// etags returns the entity tags of the variants that have one.
+func (index variantIndex) etags() []string {
+	var etags []string
+	for _, v := range index {
+		if v.etag != "" {
+			etags = append(etags, v.etag)
+		}
+	}
+	return etags
+}
+
+// cachedEntry returns the cached response for req, if present under key, with the metadata
+// of its entry, along with the variant index of key when the cached responses vary. The
+// errors of c are returned as *CacheError values.
+func cachedEntry(c Cache, key string, req *http.Request) (resp *http.Response, m entryMeta, index variantIndex, err error) {
+	ctx := req.Context()
+	r, ok, err := openEntry(ctx, c, key)
+	if !ok && err == nil {
+		b, ok, err := cacheGet(ctx, c, variantIndexKey(key))
+		if !ok {
+			return nil, m, nil, err
+		}
+		index, _ = decodeVariantIndex(b)
+		secondary, ok := index.match(req)
+		if !ok {
+			return nil, m, index, nil
+		}
+		if r, ok, err = openEntry(ctx, c, variantKey(key, secondary)); !ok {
+			return nil, m, index, err
+		}
+	} else if !ok {
+		return nil, m, nil, err
+	}
+	resp, m, err = readResponse(r, bufio.NewReader(r), req)
+	return resp, m, index, err
+}
+
+// loadVariantIndex returns the variant index of key, if any.
+func (t *Transport) loadVariantIndex(ctx context.Context, key string) variantIndex {
+	b, ok := t.cacheGet(ctx, variantIndexKey(key))
+	if !ok {
+		return nil
+	}
+	index, _ := decodeVariantIndex(b)
+	return index
+}
+
+// storeResponse stores respBytes, the response to req with the headers respHeaders, under
+// key. Responses that vary are stored as variants, and recorded in the variant index of
+// key, so that the responses selected by other requests are kept.
+func (t *Transport) storeResponse(ctx context.Context, key string, req *http.Request, respHeaders http.Header, respBytes []byte) {
+	entryKey, commit := t.beginStore(ctx, key, req, respHeaders)
+	t.cacheSet(ctx, entryKey, respBytes)
+	commit()
+}
+
+// beginStore returns the key under which the response to req with the headers respHeaders
+// is to be stored, given its cache key, and the function to call once it is stored to
+// update the variant index of key.
+func (t *Transport) beginStore(ctx context.Context, key string, req *http.Request, respHeaders http.Header) (entryKey string, commit func()) {
+	fields := headerAllCommaSepValues(respHeaders, "vary")
+	if len(fields) == 0 {
+		// The response replaces the variant index, if any, and so the variants
+		index := t.loadVariantIndex(ctx, key)
+		return key, func() {
+			for _, v := range index {
+				t.cacheDelete(ctx, variantKey(key, v.key))
+			}
+			if index != nil {
+				t.cacheDelete(ctx, variantIndexKey(key))
+			}
+		}
+	}
+	secondary := secondaryKey(fields, req)
+	etag := respHeaders.Get("etag")
+	return variantKey(key, secondary), func() {
+		index := t.loadVariantIndex(ctx, key)
+		index = append(index.remove(secondary), variant{key: secondary, etag: etag})
+		for len(index) > maxVariants {
+			t.cacheDelete(ctx, variantKey(key, index[0].key))
+			index = index[1:]
+		}
+		t.cacheSet(ctx, variantIndexKey(key), index.encode())
+		// The variants replace the response that didn't vary, if any
+		t.cacheDelete(ctx, key)
+	}
+}
+
+// deleteResponse removes the cached response selected by req under key, keeping the other
+// variants.
+func (t *Transport) deleteResponse(key string, req *http.Request) {
+	ctx := req.Context()
+	index := t.loadVariantIndex(ctx, key)
+	if index == nil {
+		t.cacheDelete(ctx, key)
+		return
+	}
+	secondary, ok := index.match(req)
+	if !ok {
+		return
+	}
+	t.cacheDelete(ctx, variantKey(key, secondary))
+	if index = index.remove(secondary); len(index) == 0 {
+		t.cacheDelete(ctx, variantIndexKey(key))
+	} else {
+		t.cacheSet(ctx, variantIndexKey(key), index.encode())
+	}
+}
+
+// deleteEntry removes the cached response under key, or all of its variants.
+func (t *Transport) deleteEntry(ctx context.Context, key string) {
+	if index := t.loadVariantIndex(ctx, key); index != nil {
+		for _, v := range index {
+			t.cacheDelete(ctx, variantKey(key, v.key))
+		}
+		t.cacheDelete(ctx, variantIndexKey(key))
+	}
+	t.cacheDelete(ctx, key)
+}
+
+// fetchVariant sends req, which selects none of the variants in index, to the server with
+// the entity tags of the stored variants as validators. If the server selects one of them
+// with a 304 Not Modified response, it is returned as selected. See
+// https://tools.ietf.org/html/rfc9111#section-4.3.2
+func (t *Transport) fetchVariant(transport http.RoundTripper, req *http.Request, key string, index variantIndex) (resp, selected *http.Response, err error) {
+	req2 := cloneRequest(req)
+	req2.Header.Set("if-none-match", strings.Join(index.etags(), ", "))
+	resp, err = transport.RoundTrip(req2)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		return resp, nil, err
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("etag")
+	for _, v := range index {
+		if etag == "" || !weakMatch(v.etag, etag) {
+			continue
+		}
+		r, ok, err := openEntry(req.Context(), t.Cache, variantKey(key, v.key))
+		t.cacheError(err)
+		if !ok {
+			break
+		}
+		selected, _, err = readResponse(r, bufio.NewReader(r), req)
+		if err == nil {
+			return resp, selected, nil
+		}
+		break
+	}
+	// The server selected a variant that is no longer stored
+	resp, err = transport.RoundTrip(req)
+	return resp, nil, err
+}
+
+// weakMatch returns true if the entity tags a and b match using the weak comparison, see
+// https://tools.ietf.org/html/rfc9110#section-8.8.3.2
+func weakMatch(a, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// updateNotModified updates cachedResp, and its metadata m, with the headers of resp, a 304
+// Not Modified response to a request sent at requestTime and received at responseTime. The
+// age of the result is that of the 304, so the stored Date and Age are dropped.
+func updateNotModified(cachedResp *http.Response, m *entryMeta, resp *http.Response, requestTime, responseTime time.Time) {
+	cachedResp.Header.Del("Age")
+	cachedResp.Header.Del("Date")
+	endToEndHeaders := getEndToEndHeaders(resp.Header)
+	for _, header := range endToEndHeaders {
+		cachedResp.Header[header] = resp.Header[header]
+	}
+	setMissingDate(cachedResp.Header, responseTime)
+	m.requestTime, m.responseTime = requestTime, responseTime
+}
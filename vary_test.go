@@ -0,0 +1,243 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptVariants returns the function answering requests for ft with the representation
+// selected by their Accept header, which is also its body, with "text/*" selecting the
+// text/plain one.
+func acceptVariants(ft *fakeTransport) func(req *http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		accept := req.Header.Get("accept")
+		if accept == "text/*" {
+			accept = "text/plain"
+		}
+		return ft.serve(req, `"`+accept+`"`, accept), nil
+	}
+}
+
+func TestVaryVariants(t *testing.T) {
+	resetTest()
+	vt := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept"}}}
+	vt.respond = acceptVariants(vt)
+	tp := NewMemoryCacheTransport()
+	tp.Transport = vt
+
+	for _, accept := range []string{"text/plain", "text/html", ""} {
+		if resp, _ := fetch(t, tp, "", "Accept", accept); resp.Header.Get(XFromCache) == "1" {
+			t.Fatalf("%q: first response came from the cache", accept)
+		}
+	}
+	for _, accept := range []string{"text/plain", "text/html", ""} {
+		resp, body := fetch(t, tp, "", "Accept", accept)
+		if resp.Header.Get(XFromCache) != "1" {
+			t.Fatalf("%q: variant wasn't cached", accept)
+		}
+		if body != accept {
+			t.Fatalf("%q: got variant %q", accept, body)
+		}
+	}
+	if vt.count() != 3 {
+		t.Fatalf("got %d upstream requests, want 3", vt.count())
+	}
+
+	// Unsafe requests invalidate all the variants
+	req, _ := http.NewRequest("POST", fakeURL, nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, accept := range []string{"text/plain", "text/html", ""} {
+		if resp, _ := fetch(t, tp, "", "Accept", accept); resp.Header.Get(XFromCache) == "1" {
+			t.Fatalf("%q: variant wasn't invalidated", accept)
+		}
+	}
+}
+
+func TestVaryStar(t *testing.T) {
+	resetTest()
+	vt := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"*"}}}
+	vt.respond = acceptVariants(vt)
+	tp := NewMemoryCacheTransport()
+	tp.Transport = vt
+
+	fetch(t, tp, "", "Accept", "text/plain")
+	if resp, _ := fetch(t, tp, "", "Accept", "text/plain"); resp.Header.Get(XFromCache) == "1" {
+		t.Fatal(`response with "Vary: *" was served from the cache`)
+	}
+}
+
+func TestVaryRevalidateVariant(t *testing.T) {
+	resetTest()
+	vt := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=0"}, "Vary": {"Accept"}}}
+	vt.respond = acceptVariants(vt)
+	tp := NewMemoryCacheTransport()
+	tp.Transport = vt
+
+	fetch(t, tp, "", "Accept", "text/plain")
+	fetch(t, tp, "", "Accept", "text/html")
+
+	// A stale variant is revalidated with its own validator
+	resp, body := fetch(t, tp, "", "Accept", "text/html")
+	if resp.Header.Get(XFromCache) != "1" || body != "text/html" {
+		t.Fatalf("got %q, cached %q; want the revalidated text/html variant", body, resp.Header.Get(XFromCache))
+	}
+	if inm := vt.request(2).Header.Get("if-none-match"); inm != `"text/html"` {
+		t.Fatalf(`got If-None-Match %q, want "text/html"`, inm)
+	}
+
+	// Requests selecting no variant offer all of them to the server
+	resp, body = fetch(t, tp, "", "Accept", "text/*")
+	if resp.Header.Get(XFromCache) != "1" || body != "text/plain" {
+		t.Fatalf("got %q, cached %q; want the text/plain variant selected by the server", body, resp.Header.Get(XFromCache))
+	}
+	inm := headerAllCommaSepValues(vt.request(3).Header, "if-none-match")
+	if len(inm) != 2 || !strings.Contains(vt.request(3).Header.Get("if-none-match"), `"text/plain"`) {
+		t.Fatalf("got If-None-Match %q, want both variants", inm)
+	}
+
+	// The selected variant is then stored for such requests too
+	vt.header.Set("Cache-Control", "max-age=3600")
+	fetch(t, tp, "", "Accept", "text/*")
+	n := vt.count()
+	resp, body = fetch(t, tp, "", "Accept", "text/*")
+	if resp.Header.Get(XFromCache) != "1" || body != "text/plain" || vt.count() != n {
+		t.Fatalf("got %q, cached %q; want the stored text/plain variant", body, resp.Header.Get(XFromCache))
+	}
+}
+
+func TestVaryBookkeepingNotLeaked(t *testing.T) {
+	resetTest()
+	vt := &fakeTransport{header: http.Header{"Cache-Control": {"max-age=3600"}, "Vary": {"Accept"}}}
+	vt.respond = acceptVariants(vt)
+	tp := NewMemoryCacheTransport()
+	tp.Transport = vt
+	get := func(accept string) *http.Response {
+		req, _ := http.NewRequest("GET", fakeURL, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := tp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if name := bookkeepingHeader(resp.Header); name != "" {
+			t.Fatalf("%q: bookkeeping header %s leaked into the response", accept, name)
+		}
+		return resp
+	}
+
+	get("text/plain")
+	if resp := get("text/plain"); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("variant wasn't cached")
+	}
+
+	// Responses stored with the request headers among their own are migrated
+	legacy := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(len("legacy")),
+		Body:          ioutil.NopCloser(strings.NewReader("legacy")),
+	}
+	legacy.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	legacy.Header.Set("Cache-Control", "max-age=3600")
+	legacy.Header.Set("Vary", "Accept")
+	legacy.Header.Set("X-Varied-Accept", "text/csv")
+	b, err := httputil.DumpResponse(legacy, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Cache.Set(fakeURL, b)
+	if resp := get("text/csv"); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("legacy response wasn't served for the request it was stored for")
+	}
+	n := vt.count()
+	if resp := get("text/html"); resp.Header.Get(XFromCache) == "1" || vt.count() != n+1 {
+		t.Fatal("legacy response was served for a request with another Accept header")
+	}
+}
+
+// getRecordingCache is a Cache recording the keys read from it.
+type getRecordingCache struct {
+	Cache
+	gets []string
+}
+
+func (c *getRecordingCache) Get(key string) ([]byte, bool) {
+	c.gets = append(c.gets, key)
+	return c.Cache.Get(key)
+}
+
+// reads returns the number of times key was read.
+func (c *getRecordingCache) reads(key string) int {
+	n := 0
+	for _, k := range c.gets {
+		if k == key {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStoreDoesNotReadResponse(t *testing.T) {
+	resetTest()
+	cache := &getRecordingCache{Cache: NewMemoryCache()}
+	tp := NewTransport(cache)
+	tp.Transport = &fakeTransport{header: http.Header{"Cache-Control": {"max-age=0"}}}
+
+	fetch(t, tp, "")
+	if got := cache.reads(fakeURL); got != 1 {
+		t.Fatalf("got %d reads of the response when storing it, want 1 for the lookup", got)
+	}
+	// The stale response is revalidated, and stored again
+	cache.gets = nil
+	if resp, _ := fetch(t, tp, ""); resp.Header.Get(XFromCache) != "1" {
+		t.Fatal("revalidated response wasn't served from the cache")
+	}
+	if got := cache.reads(fakeURL); got != 1 {
+		t.Fatalf("got %d reads of the response when revalidating it, want 1 for the lookup", got)
+	}
+	cache.gets = nil
+	req, _ := http.NewRequest("POST", fakeURL, nil)
+	resp, err := tp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := cache.reads(fakeURL); got != 0 {
+		t.Fatalf("got %d reads of the response when invalidating it, want 0", got)
+	}
+	if _, ok := cache.Cache.Get(fakeURL); ok {
+		t.Fatal("response wasn't invalidated")
+	}
+}
+
+func TestSecondaryKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", fakeURL, nil)
+	req.Header.Add("Accept-Language", "da,  en-gb;q=0.8")
+	req.Header.Add("Accept-Language", "en;q=0.7")
+	other, _ := http.NewRequest("GET", fakeURL, nil)
+	other.Header.Set("Accept-Language", "da, en-gb;q=0.8, en;q=0.7")
+
+	key := secondaryKey([]string{"accept-language", "Accept-Encoding"}, req)
+	if key != secondaryKey([]string{"Accept-Encoding", "Accept-Language"}, other) {
+		t.Fatalf("secondary keys differ for equivalent requests")
+	}
+	index := variantIndex{{key: "Accept=text%2Fhtml"}, {key: key, etag: `"x"`}}
+	decoded, ok := decodeVariantIndex(index.encode())
+	if !ok || len(decoded) != 2 || decoded[1] != index[1] {
+		t.Fatalf("got index %v after encoding, want %v", decoded, index)
+	}
+	if secondary, ok := decoded.match(other); !ok || secondary != key {
+		t.Fatalf("got match %q, want %q", secondary, key)
+	}
+}